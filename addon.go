@@ -0,0 +1,415 @@
+// addon.go
+// Loads the addon_config.yml manifest of each addon. A version 2 manifest
+// describes the addon, the addons it requires or conflicts with, the order
+// it is applied in, the deployment types it supports, the parameters that
+// are passed as build arguments, and the images it modifies. A manifest
+// without a version is read as the original map of image names to Dockerfiles.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// AddonManifestVersion is the newest addon_config.yml format that can be read
+const AddonManifestVersion = 2
+
+// Addon is the manifest of an addon directory
+type Addon struct {
+	Version         int                      `yaml:"version"`
+	Name            string                   `yaml:"name"`
+	Description     string                   `yaml:"description"`
+	Requires        []string                 `yaml:"requires"`         // Addons that must also be used
+	Conflicts       []string                 `yaml:"conflicts"`        // Addons that cannot be used at the same time
+	After           []string                 `yaml:"after"`            // Addons that are applied before this one when they are used
+	Before          []string                 `yaml:"before"`           // Addons that are applied after this one when they are used
+	DeploymentTypes []string                 `yaml:"deployment_types"` // Default: all deployment types
+	Parameters      []AddonParameter         `yaml:"parameters"`
+	Images          map[string]effectedImage `yaml:"images"`
+
+	Path   string            `yaml:"-"` // Directory of the addon, ending with a slash
+	Values map[string]string `yaml:"-"` // Value of each parameter, passed as a build argument
+}
+
+// AddonParameter is a value that can be set with the --addon-params argument
+type AddonParameter struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	Default     string `yaml:"default"`
+	Required    bool   `yaml:"required"`
+}
+
+// AddonKubernetes is the part of a Kubernetes deployment that an addon adds to an image.
+// The volumes, volume mounts, and init containers are written into the
+// deployment as they are, in the Kubernetes format.
+type AddonKubernetes struct {
+	ConfigMaps     []AddonConfigMap `yaml:"configmaps"`
+	Volumes        []interface{}    `yaml:"volumes"`
+	VolumeMounts   []interface{}    `yaml:"volume_mounts"`
+	InitContainers []interface{}    `yaml:"init_containers"`
+}
+
+// AddonConfigMap creates a ConfigMap from files in the addon directory and
+// mounts each file into the container
+type AddonConfigMap struct {
+	Name        string   `yaml:"name"`
+	Files       []string `yaml:"files"`      // <file> or <name in the container>=<file>. May use the addon parameters, such as ${SSSD_CONF}
+	MountPath   string   `yaml:"mount_path"` // Directory the files are placed in
+	DefaultMode int      `yaml:"default_mode"`
+}
+
+// LoadAddon reads and checks the addon_config.yml file in the addon directory
+func LoadAddon(path string) (*Addon, error) {
+	addon := &Addon{}
+	fileName := path + "addon_config.yml"
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return addon, err
+	}
+	err = yaml.Unmarshal(content, addon)
+	if err != nil {
+		return addon, fmt.Errorf("Unable to unmarshal file %s, %s", fileName, err.Error())
+	}
+
+	// The original format is only a map of image names to Dockerfiles
+	if addon.Version == 0 {
+		addon = &Addon{Version: 1}
+		err = yaml.Unmarshal(content, &addon.Images)
+		if err != nil {
+			return addon, fmt.Errorf("Unable to unmarshal file %s, %s", fileName, err.Error())
+		}
+	}
+	if addon.Version > AddonManifestVersion {
+		return addon, fmt.Errorf("%s has version %d, the newest version that can be read is %d",
+			fileName, addon.Version, AddonManifestVersion)
+	}
+
+	addon.Path = path
+	if len(addon.Name) == 0 {
+		addon.Name = filepath.Base(path)
+	}
+
+	for name, image := range addon.Images {
+		if len(image.Dockerfiles) == 0 && len(image.Environment) == 0 &&
+			len(image.Volumes) == 0 && len(image.Ports) == 0 &&
+			len(image.Kubernetes.ConfigMaps) == 0 && len(image.Kubernetes.Volumes) == 0 &&
+			len(image.Kubernetes.VolumeMounts) == 0 && len(image.Kubernetes.InitContainers) == 0 {
+			return addon, fmt.Errorf("The image %s in %s has no dockerfiles, environment, volumes, ports, or kubernetes section", name, fileName)
+		}
+		for _, configMap := range image.Kubernetes.ConfigMaps {
+			if len(configMap.Name) == 0 || len(configMap.Files) == 0 || len(configMap.MountPath) == 0 {
+				return addon, fmt.Errorf("A configmap of the image %s in %s needs a name, files, and a mount_path", name, fileName)
+			}
+		}
+	}
+	for _, parameter := range addon.Parameters {
+		if len(parameter.Name) == 0 {
+			return addon, fmt.Errorf("A parameter in %s has no name", fileName)
+		}
+	}
+	return addon, nil
+}
+
+// LoadAddons loads the manifest of each addon directory, checks that the addons
+// can be used together, sets the parameter values, and sorts the addons into
+// the order they are applied in.
+func (order *SoftwareOrder) LoadAddons(paths []string, parameters map[string]string) error {
+	addons := []*Addon{}
+	names := []string{}
+	for _, path := range paths {
+		addon, err := LoadAddon(path)
+		if err != nil {
+			return err
+		}
+		if stringInSlice(addon.Name, names) {
+			return fmt.Errorf("The addon %s was provided more than once", addon.Name)
+		}
+		addons = append(addons, addon)
+		names = append(names, addon.Name)
+	}
+
+	// Each ConfigMap is named after the project, so the names must be unique across the addons
+	configMapAddons := make(map[string]string)
+	for _, addon := range addons {
+		for _, image := range addon.Images {
+			for _, configMap := range image.Kubernetes.ConfigMaps {
+				owner, found := configMapAddons[configMap.Name]
+				if found && owner != addon.Name {
+					return fmt.Errorf("The addons %s and %s both have a configmap named %s", owner, addon.Name, configMap.Name)
+				}
+				configMapAddons[configMap.Name] = addon.Name
+			}
+		}
+	}
+
+	usedParameters := []string{}
+	for _, addon := range addons {
+		if len(addon.DeploymentTypes) > 0 && !stringInSlice(order.DeploymentType, addon.DeploymentTypes) {
+			return fmt.Errorf("The addon %s does not support the '%s' deployment type. Choose between %s",
+				addon.Name, order.DeploymentType, strings.Join(addon.DeploymentTypes, ", "))
+		}
+		for _, required := range addon.Requires {
+			if !stringInSlice(required, names) {
+				return fmt.Errorf("The addon %s requires the %s addon, add it to the --addons argument", addon.Name, required)
+			}
+		}
+		for _, conflict := range addon.Conflicts {
+			if stringInSlice(conflict, names) {
+				return fmt.Errorf("The addons %s and %s cannot be used together", addon.Name, conflict)
+			}
+		}
+
+		addon.Values = make(map[string]string)
+		for _, parameter := range addon.Parameters {
+			value, found := parameters[parameter.Name]
+			if !found && parameter.Required {
+				return fmt.Errorf("The addon %s requires a value for %s (%s). Set it with --addon-params %s=<value>",
+					addon.Name, parameter.Name, parameter.Description, parameter.Name)
+			}
+			if !found {
+				value = parameter.Default
+			}
+			if len(value) > 0 {
+				addon.Values[parameter.Name] = value
+			}
+			usedParameters = append(usedParameters, parameter.Name)
+		}
+	}
+	for name := range parameters {
+		if !stringInSlice(name, usedParameters) {
+			return fmt.Errorf("The --addon-params value %s is not a parameter of any of the addons", name)
+		}
+	}
+
+	sorted, err := sortAddons(addons)
+	if err != nil {
+		return err
+	}
+	order.Addons = sorted
+	order.AddOns = []string{}
+	for _, addon := range sorted {
+		order.AddOns = append(order.AddOns, addon.Path)
+	}
+	return nil
+}
+
+// sortAddons orders the addons so that each addon is applied after the addons
+// it requires and the ones in its "after" list, and before the ones in its
+// "before" list. Otherwise the order that was given on the command line is kept.
+func sortAddons(addons []*Addon) ([]*Addon, error) {
+	// The names of the addons that must be applied before each addon
+	previous := make(map[string][]string)
+	for _, addon := range addons {
+		previous[addon.Name] = append(previous[addon.Name], addon.Requires...)
+		previous[addon.Name] = append(previous[addon.Name], addon.After...)
+		for _, next := range addon.Before {
+			previous[next] = append(previous[next], addon.Name)
+		}
+	}
+
+	sorted := []*Addon{}
+	applied := []string{}
+	for len(sorted) < len(addons) {
+		progress := false
+		for _, addon := range addons {
+			if stringInSlice(addon.Name, applied) {
+				continue
+			}
+			ready := true
+			for _, name := range previous[addon.Name] {
+				if !stringInSlice(name, applied) && addonInList(name, addons) {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				sorted = append(sorted, addon)
+				applied = append(applied, addon.Name)
+				progress = true
+				break
+			}
+		}
+		if !progress {
+			remaining := []string{}
+			for _, addon := range addons {
+				if !stringInSlice(addon.Name, applied) {
+					remaining = append(remaining, addon.Name)
+				}
+			}
+			return sorted, errors.New("The addons " + strings.Join(remaining, ", ") +
+				" cannot be ordered since their after, before, or requires lists form a cycle")
+		}
+	}
+	return sorted, nil
+}
+
+// addonManifestVars gets the Kubernetes fragments of every addon that modifies the
+// container, formatted as the extra keys of the container's entry in the services
+// section of manifest-vars.yml. The manifests templates indent and write them into the
+// deployment. The files of each ConfigMap are added to its entry in the configMaps map.
+func (order *SoftwareOrder) addonManifestVars(containerName string, configMaps map[string]map[string]string) (string, error) {
+	volumes := []interface{}{}
+	volumeMounts := []interface{}{}
+	initContainers := []interface{}{}
+	for _, addon := range order.Addons {
+		image, found := addon.Images[containerName]
+		if !found {
+			continue
+		}
+		fragment := image.Kubernetes
+		volumes = append(volumes, fragment.Volumes...)
+		volumeMounts = append(volumeMounts, fragment.VolumeMounts...)
+		initContainers = append(initContainers, fragment.InitContainers...)
+
+		for _, configMap := range fragment.ConfigMaps {
+			configMapName := order.ProjectName + "-addon-" + configMap.Name
+			volumeName := configMapName + "-volume"
+			volume := map[string]interface{}{
+				"name":      volumeName,
+				"configMap": map[string]interface{}{"name": configMapName},
+			}
+			if configMap.DefaultMode > 0 {
+				volume["configMap"].(map[string]interface{})["defaultMode"] = configMap.DefaultMode
+			}
+			volumes = append(volumes, volume)
+
+			// An addon can mount one ConfigMap into several images, so the files of each image are merged into it
+			data, found := configMaps[configMap.Name]
+			if !found {
+				data = make(map[string]string)
+				configMaps[configMap.Name] = data
+			}
+			for _, file := range configMap.Files {
+				file = os.Expand(file, func(name string) string { return addon.Values[name] })
+				key := file
+				if fields := strings.SplitN(file, "=", 2); len(fields) == 2 {
+					key = fields[0]
+					file = fields[1]
+				}
+				content, err := ioutil.ReadFile(addon.Path + file)
+				if err != nil {
+					return "", fmt.Errorf("Unable to read the file %s for the %s configmap of the %s addon, %s",
+						file, configMap.Name, addon.Name, err.Error())
+				}
+				if existing, found := data[key]; found && existing != string(content) {
+					return "", fmt.Errorf("The %s configmap of the %s addon has more than one %s file with different content",
+						configMap.Name, addon.Name, key)
+				}
+				data[key] = string(content)
+
+				// Mount each file on its own so the rest of the directory is kept
+				volumeMounts = append(volumeMounts, map[string]interface{}{
+					"name":      volumeName,
+					"mountPath": strings.TrimSuffix(configMap.MountPath, "/") + "/" + key,
+					"subPath":   key,
+				})
+			}
+		}
+	}
+
+	vars := ""
+	sections := []struct {
+		key   string
+		items []interface{}
+	}{
+		{"addon_volumes", volumes},
+		{"addon_volume_mounts", volumeMounts},
+		{"addon_init_containers", initContainers},
+	}
+	for _, section := range sections {
+		if len(section.items) == 0 {
+			continue
+		}
+		content, err := yaml.Marshal(section.items)
+		if err != nil {
+			return "", err
+		}
+
+		// The list is kept as a block of text, like the deployment_overrides in manifests_usermods.yml
+		vars += "    " + section.key + ": |\n"
+		for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+			vars += "      " + line + "\n"
+		}
+	}
+	return vars, nil
+}
+
+// addonInList checks if an addon with the name is in the list
+func addonInList(name string, addons []*Addon) bool {
+	for _, addon := range addons {
+		if addon.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddonParams splits the --addon-params argument "NAME=VALUE,NAME=VALUE" into a map.
+// A value that has commas, such as an LDAP DN, is quoted: NAME="ou=users,dc=example,dc=com"
+func parseAddonParams(argument string) (map[string]string, error) {
+	parameters := make(map[string]string)
+	argument = strings.TrimSpace(argument)
+	if len(argument) == 0 {
+		return parameters, nil
+	}
+
+	// Split on the commas outside of quotes, and remove the quotes
+	pairs := []string{}
+	pair := ""
+	quote := rune(0)
+	for _, character := range argument {
+		switch {
+		case quote != 0 && character == quote:
+			quote = 0
+		case quote != 0:
+			pair += string(character)
+		case character == '"' || character == '\'':
+			quote = character
+		case character == ',':
+			pairs = append(pairs, pair)
+			pair = ""
+		default:
+			pair += string(character)
+		}
+	}
+	if quote != 0 {
+		return parameters, fmt.Errorf("The --addon-params value has a %c quote that is never closed", quote)
+	}
+	pairs = append(pairs, pair)
+
+	for _, pair := range pairs {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		fields := strings.SplitN(pair, "=", 2)
+		name := strings.TrimSpace(fields[0])
+		if len(fields) != 2 || len(name) == 0 {
+			return parameters, fmt.Errorf("The --addon-params value '%s' must be in the NAME=VALUE format", pair)
+		}
+		parameters[name] = fields[1]
+	}
+	return parameters, nil
+}
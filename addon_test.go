@@ -0,0 +1,352 @@
+// addon_test.go
+// Tests the loading, checking, and ordering of the addons.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadAddons(t *testing.T) {
+	tests := []struct {
+		description    string
+		manifests      map[string]string // addon_config.yml of each addon directory
+		addons         []string          // Addon directories in the order they are given
+		deploymentType string
+		parameters     map[string]string
+		sorted         []string
+		values         map[string]map[string]string // Parameter values of each addon
+		err            string
+	}{
+		{
+			description: "original format",
+			manifests:   map[string]string{"auth-demo": "programming:\n  dockerfiles:\n    - Dockerfile\n"},
+			addons:      []string{"auth-demo"},
+			sorted:      []string{"auth-demo"},
+			values:      map[string]map[string]string{"auth-demo": {}},
+		},
+		{
+			description: "newer manifest version",
+			manifests:   map[string]string{"auth-demo": "version: 3\nname: auth-demo\n"},
+			addons:      []string{"auth-demo"},
+			err:         "the newest version that can be read is 2",
+		},
+		{
+			description: "image without changes",
+			manifests:   map[string]string{"auth-demo": "version: 2\nimages:\n  programming: {}\n"},
+			addons:      []string{"auth-demo"},
+			err:         "The image programming in",
+		},
+		{
+			description: "addon given more than once",
+			manifests:   map[string]string{"auth-demo": "version: 2\nname: auth\n", "auth-sssd": "version: 2\nname: auth\n"},
+			addons:      []string{"auth-demo", "auth-sssd"},
+			err:         "The addon auth was provided more than once",
+		},
+		{
+			description: "required addon is used",
+			manifests: map[string]string{
+				"ide-jupyter-python3": "version: 2\nrequires: [auth-sssd]\n",
+				"auth-sssd":           "version: 2\n",
+			},
+			addons: []string{"ide-jupyter-python3", "auth-sssd"},
+			sorted: []string{"auth-sssd", "ide-jupyter-python3"},
+		},
+		{
+			description: "required addon is missing",
+			manifests:   map[string]string{"ide-jupyter-python3": "version: 2\nrequires: [auth-sssd]\n"},
+			addons:      []string{"ide-jupyter-python3"},
+			err:         "requires the auth-sssd addon",
+		},
+		{
+			description: "conflicting addons",
+			manifests: map[string]string{
+				"auth-demo": "version: 2\nconflicts: [auth-sssd]\n",
+				"auth-sssd": "version: 2\n",
+			},
+			addons: []string{"auth-demo", "auth-sssd"},
+			err:    "The addons auth-demo and auth-sssd cannot be used together",
+		},
+		{
+			description:    "supported deployment type",
+			manifests:      map[string]string{"auth-demo": "version: 2\ndeployment_types: [single, multiple]\n"},
+			addons:         []string{"auth-demo"},
+			deploymentType: "multiple",
+			sorted:         []string{"auth-demo"},
+		},
+		{
+			description:    "unsupported deployment type",
+			manifests:      map[string]string{"auth-demo": "version: 2\ndeployment_types: [single]\n"},
+			addons:         []string{"auth-demo"},
+			deploymentType: "full",
+			err:            "does not support the 'full' deployment type",
+		},
+		{
+			description: "parameters and defaults",
+			manifests: map[string]string{
+				"auth-sssd": "version: 2\nparameters:\n  - name: LDAP_BASE_DN\n    required: true\n" +
+					"  - name: SSSD_CONF\n    default: sssd.conf\n  - name: KRB5_CONF\n",
+			},
+			addons:     []string{"auth-sssd"},
+			parameters: map[string]string{"LDAP_BASE_DN": "dc=example,dc=com"},
+			sorted:     []string{"auth-sssd"},
+			values:     map[string]map[string]string{"auth-sssd": {"LDAP_BASE_DN": "dc=example,dc=com", "SSSD_CONF": "sssd.conf"}},
+		},
+		{
+			description: "required parameter is missing",
+			manifests:   map[string]string{"auth-sssd": "version: 2\nparameters:\n  - name: LDAP_BASE_DN\n    required: true\n"},
+			addons:      []string{"auth-sssd"},
+			err:         "requires a value for LDAP_BASE_DN",
+		},
+		{
+			description: "parameter of no addon",
+			manifests:   map[string]string{"auth-sssd": "version: 2\n"},
+			addons:      []string{"auth-sssd"},
+			parameters:  map[string]string{"LDAP_BASE_DN": "dc=example,dc=com"},
+			err:         "LDAP_BASE_DN is not a parameter of any of the addons",
+		},
+		{
+			description: "configmap name used by two addons",
+			manifests: map[string]string{
+				"auth-demo": "version: 2\nimages:\n  programming:\n    kubernetes:\n      configmaps:\n" +
+					"        - {name: auth, files: [demo.conf], mount_path: /etc/demo}\n",
+				"auth-sssd": "version: 2\nimages:\n  cas:\n    kubernetes:\n      configmaps:\n" +
+					"        - {name: auth, files: [sssd.conf], mount_path: /etc/sssd}\n",
+			},
+			addons: []string{"auth-demo", "auth-sssd"},
+			err:    "both have a configmap named auth",
+		},
+	}
+	for _, test := range tests {
+		directory := t.TempDir()
+		paths := []string{}
+		for _, name := range test.addons {
+			path := filepath.Join(directory, name) + "/"
+			err := os.MkdirAll(path, 0755)
+			if err == nil {
+				err = ioutil.WriteFile(path+"addon_config.yml", []byte(test.manifests[name]), 0644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths = append(paths, path)
+		}
+		deploymentType := test.deploymentType
+		if len(deploymentType) == 0 {
+			deploymentType = "single"
+		}
+		order := &SoftwareOrder{DeploymentType: deploymentType}
+
+		err := order.LoadAddons(paths, test.parameters)
+		if !errorContains(err, test.err) {
+			t.Errorf("%s: error = %v, want %q", test.description, err, test.err)
+			continue
+		}
+		if len(test.err) > 0 {
+			continue
+		}
+		sorted := []string{}
+		for index, addon := range order.Addons {
+			sorted = append(sorted, addon.Name)
+			if order.AddOns[index] != addon.Path {
+				t.Errorf("%s: AddOns[%d] = %s, want %s", test.description, index, order.AddOns[index], addon.Path)
+			}
+			if want, found := test.values[addon.Name]; found && !reflect.DeepEqual(addon.Values, want) {
+				t.Errorf("%s: values of %s = %v, want %v", test.description, addon.Name, addon.Values, want)
+			}
+		}
+		if !reflect.DeepEqual(sorted, test.sorted) {
+			t.Errorf("%s: addons = %v, want %v", test.description, sorted, test.sorted)
+		}
+	}
+}
+
+func TestSortAddons(t *testing.T) {
+	tests := []struct {
+		description string
+		addons      []*Addon
+		sorted      string
+		err         string
+	}{
+		{
+			description: "command line order is kept",
+			addons:      []*Addon{{Name: "c"}, {Name: "a"}, {Name: "b"}},
+			sorted:      "c a b",
+		},
+		{
+			description: "after",
+			addons:      []*Addon{{Name: "a", After: []string{"b"}}, {Name: "b"}, {Name: "c"}},
+			sorted:      "b a c",
+		},
+		{
+			description: "before",
+			addons:      []*Addon{{Name: "a"}, {Name: "b"}, {Name: "c", Before: []string{"a"}}},
+			sorted:      "b c a",
+		},
+		{
+			description: "requires",
+			addons:      []*Addon{{Name: "a", Requires: []string{"c"}}, {Name: "b"}, {Name: "c"}},
+			sorted:      "b c a",
+		},
+		{
+			description: "after and before an addon that is not used",
+			addons:      []*Addon{{Name: "a", After: []string{"x"}}, {Name: "b", Before: []string{"y"}}},
+			sorted:      "a b",
+		},
+		{
+			description: "chain",
+			addons:      []*Addon{{Name: "a", After: []string{"b"}}, {Name: "b", After: []string{"c"}}, {Name: "c"}},
+			sorted:      "c b a",
+		},
+		{
+			description: "cycle",
+			addons: []*Addon{
+				{Name: "a", After: []string{"b"}, Before: []string{"c"}},
+				{Name: "b", Requires: []string{"c"}},
+				{Name: "c"},
+				{Name: "d"},
+			},
+			err: "The addons a, b, c cannot be ordered",
+		},
+		{
+			description: "addon after itself",
+			addons:      []*Addon{{Name: "a", After: []string{"a"}}},
+			err:         "The addons a cannot be ordered",
+		},
+	}
+	for _, test := range tests {
+		sorted, err := sortAddons(test.addons)
+		if !errorContains(err, test.err) {
+			t.Errorf("%s: error = %v, want %q", test.description, err, test.err)
+			continue
+		}
+		if len(test.err) > 0 {
+			continue
+		}
+		names := []string{}
+		for _, addon := range sorted {
+			names = append(names, addon.Name)
+		}
+		if strings.Join(names, " ") != test.sorted {
+			t.Errorf("%s: sorted = %s, want %s", test.description, strings.Join(names, " "), test.sorted)
+		}
+	}
+}
+
+func TestAddonManifestVarsConfigMaps(t *testing.T) {
+	tests := []struct {
+		description string
+		images      map[string][]string // Files of the sssd configmap for each image
+		data        map[string]string
+		err         string
+	}{
+		{
+			description: "one image",
+			images:      map[string][]string{"programming": {"sssd.conf"}},
+			data:        map[string]string{"sssd.conf": "[sssd]"},
+		},
+		{
+			description: "the files of each image are merged",
+			images:      map[string][]string{"programming": {"sssd.conf"}, "cas": {"krb5.conf"}},
+			data:        map[string]string{"sssd.conf": "[sssd]", "krb5.conf": "[libdefaults]"},
+		},
+		{
+			description: "the same file for each image",
+			images:      map[string][]string{"programming": {"sssd.conf"}, "cas": {"sssd.conf"}},
+			data:        map[string]string{"sssd.conf": "[sssd]"},
+		},
+		{
+			description: "different files with the same name",
+			images:      map[string][]string{"programming": {"sssd.conf"}, "cas": {"sssd.conf=cas-sssd.conf"}},
+			err:         "more than one sssd.conf file with different content",
+		},
+	}
+	for _, test := range tests {
+		directory := t.TempDir()
+		for name, content := range map[string]string{"sssd.conf": "[sssd]", "cas-sssd.conf": "[sssd]\ndomains = cas", "krb5.conf": "[libdefaults]"} {
+			err := ioutil.WriteFile(filepath.Join(directory, name), []byte(content), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		addon := &Addon{Name: "auth-sssd", Path: directory + "/", Images: make(map[string]effectedImage)}
+		for image, files := range test.images {
+			addon.Images[image] = effectedImage{Kubernetes: AddonKubernetes{
+				ConfigMaps: []AddonConfigMap{{Name: "sssd", Files: files, MountPath: "/etc/sssd"}},
+			}}
+		}
+		order := &SoftwareOrder{ProjectName: "sas-viya", Addons: []*Addon{addon}}
+
+		configMaps := make(map[string]map[string]string)
+		var err error
+		for _, image := range []string{"programming", "cas"} {
+			_, err = order.addonManifestVars(image, configMaps)
+			if err != nil {
+				break
+			}
+		}
+		if !errorContains(err, test.err) {
+			t.Errorf("%s: error = %v, want %q", test.description, err, test.err)
+			continue
+		}
+		if len(test.err) == 0 && !reflect.DeepEqual(configMaps["sssd"], test.data) {
+			t.Errorf("%s: configmap data = %v, want %v", test.description, configMaps["sssd"], test.data)
+		}
+	}
+}
+
+func TestParseAddonParams(t *testing.T) {
+	tests := []struct {
+		argument   string
+		parameters map[string]string
+		err        string
+	}{
+		{argument: "", parameters: map[string]string{}},
+		{argument: "JUPYTER_TOKEN=mytoken", parameters: map[string]string{"JUPYTER_TOKEN": "mytoken"}},
+		{
+			argument:   " JUPYTER_TOKEN=mytoken , ENABLE_TERMINAL=False,",
+			parameters: map[string]string{"JUPYTER_TOKEN": "mytoken", "ENABLE_TERMINAL": "False"},
+		},
+		{argument: "MESSAGE=hello world", parameters: map[string]string{"MESSAGE": "hello world"}},
+		{
+			argument:   `LDAP_BASE_DN="ou=users,dc=example,dc=com",SSSD_CONF=sssd.conf`,
+			parameters: map[string]string{"LDAP_BASE_DN": "ou=users,dc=example,dc=com", "SSSD_CONF": "sssd.conf"},
+		},
+		{argument: `LDAP_BASE_DN='ou=users, dc=example'`, parameters: map[string]string{"LDAP_BASE_DN": "ou=users, dc=example"}},
+		{argument: `MESSAGE="it's"`, parameters: map[string]string{"MESSAGE": "it's"}},
+		{argument: "EMPTY=", parameters: map[string]string{"EMPTY": ""}},
+		{argument: "JUPYTER_TOKEN", err: "must be in the NAME=VALUE format"},
+		{argument: "=mytoken", err: "must be in the NAME=VALUE format"},
+		{argument: `LDAP_BASE_DN="ou=users,dc=example`, err: "quote that is never closed"},
+	}
+	for _, test := range tests {
+		parameters, err := parseAddonParams(test.argument)
+		if !errorContains(err, test.err) {
+			t.Errorf("parseAddonParams(%q) error = %v, want %q", test.argument, err, test.err)
+			continue
+		}
+		if len(test.err) == 0 && !reflect.DeepEqual(parameters, test.parameters) {
+			t.Errorf("parseAddonParams(%q) = %v, want %v", test.argument, parameters, test.parameters)
+		}
+	}
+}
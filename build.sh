@@ -51,8 +51,12 @@ function sas_container_recipes_shutdown() {
     echo
 
     set +e
+    # The builder runs under "go run", which does not pass signals on, so the interrupt is sent
+    # to every process in the container. The builder stops its Docker builds and cleans up.
+    echo "[INFO]  : Stop the builds in ${SAS_BUILD_CONTAINER_NAME} if it is running"
+    docker exec ${SAS_BUILD_CONTAINER_NAME} sh -c 'kill -INT -1' 2>/dev/null
     echo "[INFO]  : Stop ${SAS_BUILD_CONTAINER_NAME} if it is running"
-    docker stop ${SAS_BUILD_CONTAINER_NAME}
+    docker stop --time 60 ${SAS_BUILD_CONTAINER_NAME}
     echo "[INFO]  : Remove ${SAS_BUILD_CONTAINER_NAME}"
     docker rm -f ${SAS_BUILD_CONTAINER_NAME}
     set -e
@@ -62,6 +66,13 @@ function sas_container_recipes_shutdown() {
 trap sas_container_recipes_shutdown SIGTERM
 trap sas_container_recipes_shutdown SIGINT
 
+# The first argument can be a command that is run instead of a build
+SAS_COMMAND=""
+if [[ $1 == "inspect" || $1 == "promote" ]]; then
+    SAS_COMMAND="$1"
+    shift
+fi
+
 # Parse command arguments and flags
 while [[ $# -gt 0 ]]; do
     key="$1"
@@ -102,7 +113,21 @@ while [[ $# -gt 0 ]]; do
             ;;
         -k|--skip-mirror-url-validation)
             shift # past argument
-	    echo -e "\nNote: -k|--skip-mirror-url-validation has been deprecated. This function is no longer performed and its usage can be ignored.\n"
+            CHECK_MIRROR_URL=false
+            ;;
+        --offline)
+            shift # past argument
+            OFFLINE=true
+            ;;
+        --orchestration-tool)
+            shift # past argument
+            ORCHESTRATION_TOOL="$1"
+            shift # past value
+            ;;
+        --base-image-tar)
+            shift # past argument
+            BASE_IMAGE_TAR="$1"
+            shift # past value
             ;;
         -d|--skip-docker-url-validation)
             shift # past argument
@@ -112,11 +137,49 @@ while [[ $# -gt 0 ]]; do
             shift # past argument
             SKIP_DOCKER_REGISTRY_PUSH=true
             ;;
+        --multi-stage)
+            shift # past argument
+            MULTI_STAGE=true
+            ;;
+        --keep-build-context)
+            shift # past argument
+            KEEP_BUILD_CONTEXT=true
+            ;;
+        --sbom)
+            shift # past argument
+            SBOM_FORMAT="$1"
+            shift # past value
+            ;;
+        --sign-key)
+            shift # past argument
+            SIGN_KEY="$1"
+            shift # past value
+            ;;
+        --scanner)
+            shift # past argument
+            SCANNER="$1"
+            shift # past value
+            ;;
+        --scan-severity)
+            shift # past argument
+            SCAN_SEVERITY="$1"
+            shift # past value
+            ;;
+        --scan-cache-dir)
+            shift # past argument
+            SCAN_CACHE_DIR="$1"
+            shift # past value
+            ;;
         -a|--addons)
             shift # past argument
             ADDONS="$1"
             shift # past value
             ;;
+        --addon-params)
+            shift # past argument
+            ADDON_PARAMS="$1"
+            shift # past value
+            ;;
         -y|--type)
             shift # past argument
             SAS_RECIPE_TYPE="$1"
@@ -161,11 +224,58 @@ while [[ $# -gt 0 ]]; do
             export BUILD_ONLY="$1"
             shift # past value
             ;;
+        --with-dependencies)
+            shift # past argument
+            WITH_DEPENDENCIES=true
+            ;;
+        --changed-only)
+            shift # past argument
+            CHANGED_ONLY=true
+            ;;
+        --status-addr)
+            shift # past argument
+            STATUS_ADDR="$1"
+            shift # past value
+            ;;
+        --build-timeout)
+            shift # past argument
+            BUILD_TIMEOUT="$1"
+            shift # past value
+            ;;
+        --push-timeout)
+            shift # past argument
+            PUSH_TIMEOUT="$1"
+            shift # past value
+            ;;
+        --retries)
+            shift # past argument
+            RETRIES="$1"
+            shift # past value
+            ;;
+        --retry-delay)
+            shift # past argument
+            RETRY_DELAY="$1"
+            shift # past value
+            ;;
         -w|--workers)
             shift # past argument
             export WORKERS="$1"
             shift # past value
             ;;
+        --ignore-hosts)
+            shift # past argument
+            IGNORE_HOSTS="$1"
+            shift # past value
+            ;;
+        --cas-workers)
+            shift # past argument
+            CAS_WORKERS="$1"
+            shift # past value
+            ;;
+        --cas-secondary)
+            shift # past argument
+            CAS_SECONDARY=true
+            ;;
         *)
             usage
             echo -e "\n\nOne or more arguments were not recognized: \n$@"
@@ -178,11 +288,15 @@ done
 
 # Set some defaults
 [[ -z ${CHECK_DOCKER_URL+x} ]]          && CHECK_DOCKER_URL=true
+[[ -z ${CHECK_MIRROR_URL+x} ]]          && CHECK_MIRROR_URL=true
+[[ -z ${OFFLINE+x} ]]                   && OFFLINE=false
 [[ -z ${SKIP_DOCKER_REGISTRY_PUSH+x} ]] && SKIP_DOCKER_REGISTRY_PUSH=false
 
 git_sha=$(git rev-parse --short HEAD 2>/dev/null || echo "no-git-sha")
 datetime=$(date "+%Y%m%d%H%M%S")
 sas_recipe_version=$(cat docs/VERSION)
+# The promote command keeps the tag of the build unless a --tag is provided
+promote_tag=${SAS_DOCKER_TAG}
 [[ -z ${SAS_DOCKER_TAG+x} ]] && SAS_DOCKER_TAG=${sas_recipe_version}-${datetime}-${git_sha}
 SAS_BUILD_CONTAINER_NAME="sas-container-recipes-builder-${SAS_DOCKER_TAG}"
 SAS_BUILD_CONTAINER_TAG=${sas_recipe_version}-${datetime}-${git_sha}
@@ -233,10 +347,20 @@ if [[ -n ${ADDONS} ]]; then
     run_args="${run_args} --addons ${ADDONS}"
 fi
 
+# The values may have spaces, so they are passed as a single argument
+addon_params_args=()
+if [[ -n ${ADDON_PARAMS} ]]; then
+    addon_params_args=(--addon-params "${ADDON_PARAMS}")
+fi
+
 if [[ -n ${CAS_VIRTUAL_HOST} ]]; then
     run_args="${run_args} --virtual-host '${CAS_VIRTUAL_HOST## }'"
 fi
 
+if [[ ${CHECK_MIRROR_URL} == false ]]; then
+    run_args="${run_args} --skip-mirror-url-validation"
+fi
+
 if [[ ${CHECK_DOCKER_URL} == false ]]; then
     run_args="${run_args} --skip-docker-url-validation"
 fi
@@ -254,13 +378,146 @@ if [[ -n ${PROJECT_NAME} ]]; then
 fi
 
 if [[ -n ${BUILD_ONLY} ]]; then
+    BUILD_ONLY=${BUILD_ONLY// /,} # replace spaces with a comma
     run_args="${run_args} --build-only ${BUILD_ONLY}"
 fi
 
+if [[ ${WITH_DEPENDENCIES} == true ]]; then
+    run_args="${run_args} --with-dependencies"
+fi
+
+if [[ ${CHANGED_ONLY} == true ]]; then
+    run_args="${run_args} --changed-only"
+fi
+
+if [[ -n ${BUILD_TIMEOUT} ]]; then
+    run_args="${run_args} --build-timeout ${BUILD_TIMEOUT}"
+fi
+
+if [[ -n ${PUSH_TIMEOUT} ]]; then
+    run_args="${run_args} --push-timeout ${PUSH_TIMEOUT}"
+fi
+
+if [[ -n ${RETRIES} ]]; then
+    run_args="${run_args} --retries ${RETRIES}"
+fi
+
+if [[ -n ${RETRY_DELAY} ]]; then
+    run_args="${run_args} --retry-delay ${RETRY_DELAY}"
+fi
+
+# The builder listens on the port inside its container, which is published on the host's address
+status_port=""
+if [[ -n ${STATUS_ADDR} ]]; then
+    status_host=${STATUS_ADDR%:*}
+    status_port_number=${STATUS_ADDR##*:}
+    run_args="${run_args} --status-addr :${status_port_number}"
+    if [[ -n ${status_host} ]]; then
+        status_port="-p ${status_host}:${status_port_number}:${status_port_number}"
+    else
+        status_port="-p ${status_port_number}:${status_port_number}"
+    fi
+fi
+
 if [[ ${SKIP_DOCKER_REGISTRY_PUSH} == true  ]]; then
     run_args="${run_args} --skip-docker-registry-push"
 fi
 
+if [[ ${MULTI_STAGE} == true ]]; then
+    run_args="${run_args} --multi-stage"
+fi
+
+if [[ ${KEEP_BUILD_CONTEXT} == true ]]; then
+    run_args="${run_args} --keep-build-context"
+fi
+
+if [[ -n ${SBOM_FORMAT} ]]; then
+    run_args="${run_args} --sbom ${SBOM_FORMAT}"
+fi
+
+# The signing key is mounted into the build container next to the SOE zip
+sign_key_volume=""
+if [[ -n ${SIGN_KEY} ]]; then
+    sign_key_volume="-v $(realpath ${SIGN_KEY}):/$(basename ${SIGN_KEY}):ro"
+    run_args="${run_args} --sign-key /$(basename ${SIGN_KEY})"
+fi
+
+if [[ ${OFFLINE} == true ]]; then
+    run_args="${run_args} --offline"
+fi
+
+# Local copies of the orchestration tool and the base image are mounted into the build container
+local_file_volumes=""
+if [[ -n ${ORCHESTRATION_TOOL} ]]; then
+    local_file_volumes="-v $(realpath ${ORCHESTRATION_TOOL}):/$(basename ${ORCHESTRATION_TOOL}):ro"
+    run_args="${run_args} --orchestration-tool /$(basename ${ORCHESTRATION_TOOL})"
+fi
+
+if [[ -n ${BASE_IMAGE_TAR} ]]; then
+    local_file_volumes="${local_file_volumes} -v $(realpath ${BASE_IMAGE_TAR}):/$(basename ${BASE_IMAGE_TAR}):ro"
+    run_args="${run_args} --base-image-tar /$(basename ${BASE_IMAGE_TAR})"
+fi
+
+# The scanner and its vulnerability database are mounted into the build container
+scanner_volumes=""
+if [[ -n ${SCANNER} ]]; then
+    scanner_volumes="-v $(realpath ${SCANNER}):/usr/local/bin/$(basename ${SCANNER}):ro"
+    run_args="${run_args} --scanner /usr/local/bin/$(basename ${SCANNER})"
+fi
+
+if [[ -n ${SCAN_CACHE_DIR} ]]; then
+    scanner_volumes="${scanner_volumes} -v $(realpath ${SCAN_CACHE_DIR}):/home/sas/.cache/scanner"
+    run_args="${run_args} --scan-cache-dir /home/sas/.cache/scanner"
+fi
+
+if [[ -n ${SCAN_SEVERITY} ]]; then
+    run_args="${run_args} --scan-severity ${SCAN_SEVERITY}"
+fi
+
+if [[ ${git_sha} != "no-git-sha" ]]; then
+    run_args="${run_args} --git-sha ${git_sha}"
+fi
+
+if [[ -n ${IGNORE_HOSTS+x} ]]; then
+    run_args="${run_args} --ignore-hosts=${IGNORE_HOSTS// /,}"
+fi
+
+if [[ -n ${CAS_WORKERS} ]]; then
+    run_args="${run_args} --cas-workers ${CAS_WORKERS}"
+fi
+
+if [[ ${CAS_SECONDARY} == true ]]; then
+    run_args="${run_args} --cas-secondary"
+fi
+
+# The inspect command only reads the builds directory
+if [[ ${SAS_COMMAND} == "inspect" ]]; then
+    run_args="inspect"
+    if [[ -n ${SAS_RECIPE_TYPE} ]]; then
+        run_args="${run_args} --type ${SAS_RECIPE_TYPE}"
+    fi
+    if [[ -n ${IGNORE_HOSTS+x} ]]; then
+        run_args="${run_args} --ignore-hosts=${IGNORE_HOSTS// /,}"
+    fi
+fi
+
+# The promote command copies the images of the most recent build to another registry
+if [[ ${SAS_COMMAND} == "promote" ]]; then
+    run_args="promote --docker-registry-url ${DOCKER_REGISTRY_URL} --docker-namespace ${DOCKER_REGISTRY_NAMESPACE}"
+    if [[ -n ${SAS_RECIPE_TYPE} ]]; then
+        run_args="${run_args} --type ${SAS_RECIPE_TYPE}"
+    fi
+    if [[ -n ${promote_tag} ]]; then
+        run_args="${run_args} --tag ${promote_tag}"
+    fi
+fi
+
+# The SOE zip is mounted into the build container, if one was provided
+zip_volume=""
+if [[ -n ${SAS_VIYA_DEPLOYMENT_DATA_ZIP} ]]; then
+    zip_volume="-v $(realpath ${SAS_VIYA_DEPLOYMENT_DATA_ZIP}):/$(basename ${SAS_VIYA_DEPLOYMENT_DATA_ZIP})"
+fi
+
 echo "==============================="
 echo "Building Docker Build Container"
 echo "==============================="
@@ -286,25 +543,42 @@ echo
 # If a Docker config exists then run the builder with the config mounted as a volume.
 # Otherwise, not having a Docker config is acceptable if no registry authentication is required.
 DOCKER_CONFIG_PATH=${HOME}/.docker/config.json
+
+# On a terminal the builder shows a line for each container that is redrawn as the builds progress
+tty_flag=""
+if [[ -t 1 ]]; then
+    tty_flag="-t"
+fi
+
+# The run_args can have glob patterns from --build-only, which are expanded by the builder, not the shell
+set -f
 if [[ -f ${DOCKER_CONFIG_PATH} ]]; then 
-    docker run -d \
+    docker run -d ${tty_flag} \
         --name ${SAS_BUILD_CONTAINER_NAME} \
         --ulimit memlock=-1 \
         -u ${UID}:${DOCKER_GID} \
-        -v $(realpath ${SAS_VIYA_DEPLOYMENT_DATA_ZIP}):/$(basename ${SAS_VIYA_DEPLOYMENT_DATA_ZIP}) \
+        ${zip_volume} \
         -v ${PWD}/builds:/sas-container-recipes/builds \
         -v /var/run/docker.sock:/var/run/docker.sock \
         -v ${HOME}/.docker/config.json:/home/sas/.docker/config.json \
-        sas-container-recipes-builder:${SAS_DOCKER_TAG} ${run_args}
+        ${sign_key_volume} \
+        ${scanner_volumes} \
+        ${local_file_volumes} \
+        ${status_port} \
+        sas-container-recipes-builder:${SAS_DOCKER_TAG} ${run_args} "${addon_params_args[@]}"
 else 
-    docker run -d \
+    docker run -d ${tty_flag} \
         --name ${SAS_BUILD_CONTAINER_NAME} \
         --ulimit memlock=-1 \
         -u ${UID}:${DOCKER_GID} \
-        -v $(realpath ${SAS_VIYA_DEPLOYMENT_DATA_ZIP}):/$(basename ${SAS_VIYA_DEPLOYMENT_DATA_ZIP}) \
+        ${zip_volume} \
         -v ${PWD}/builds:/sas-container-recipes/builds \
         -v /var/run/docker.sock:/var/run/docker.sock \
-        sas-container-recipes-builder:${SAS_DOCKER_TAG} ${run_args}
+        ${sign_key_volume} \
+        ${scanner_volumes} \
+        ${local_file_volumes} \
+        ${status_port} \
+        sas-container-recipes-builder:${SAS_DOCKER_TAG} ${run_args} "${addon_params_args[@]}"
 fi
 docker logs -f ${SAS_BUILD_CONTAINER_NAME}
 
@@ -24,21 +24,25 @@ package main
 
 import (
 	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"path"
 	"path/filepath"
-	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types"
+	dockercontainer "github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"gopkg.in/yaml.v2"
 )
@@ -57,8 +61,21 @@ const (
 	Built      State = 8  // Docker client has built and tagged the last layer
 	Pushing    State = 9  // Image is in the process of being pushed to the provided registry
 	Pushed     State = 10 // Image has finished pushing to the provided registry
+	Retagged   State = 11 // Image is unchanged since the previous build, so the previous image was tagged in the registry
 )
 
+// String gets the name of the state, such as "Pushed"
+func (state State) String() string {
+	names := map[State]string{
+		Unknown: "Unknown", DoNotBuild: "DoNotBuild", Failed: "Failed", Loading: "Loading", Loaded: "Loaded",
+		Building: "Building", Built: "Built", Pushing: "Pushing", Pushed: "Pushed", Retagged: "Retagged",
+	}
+	if name, found := names[state]; found {
+		return name
+	}
+	return fmt.Sprintf("State(%d)", int(state))
+}
+
 // DockerAPIVersion is the minimum version of the API we support
 const DockerAPIVersion = "1.37"
 
@@ -77,10 +94,12 @@ type Container struct {
 	// Builder attributes
 	BuildArgs         map[string]*string // Arguments that are passed into the Docker builder https://docs.docker.com/engine/reference/commandline/build/
 	BuildPath         string             // Path to the inner container build directory: builds/<deployment-type>-<date>-<time>/<project_name>-<container_name>/
-	ContextWriter     *tar.Writer        // Writes to a tar file that's passed to the Docker daemon as the build context
+	ContextFiles      map[string]File    // Payload streamed to the Docker builder by their path inside the context. Includes all files and the Dockerfile for the build
+	ContextHash       string             // sha256 of the name, header, and content hash of each entry in the Docker context
+	ContextDigests    map[string]string  // sha256 of each file in the Docker context. Kept after the context is released so it can be listed in the SBOM
+	Fingerprint       string             // sha256 of the image's inputs, which the --changed-only argument compares to the previous build
 	Dockerfile        string             // Generated from the container's included roles
-	DockerContext     *os.File           // Payload sent to the Docker builder, includes all files and the Dockerfile for the build
-	DockerContextPath string             // Location of the tar file, which is passed to the Docker client
+	DockerContextPath string             // Location of the tar file that is written with the --keep-build-context argument
 	DockerClient      *client.Client     // Individual connection to the Docker daemon, which allows for concurrency
 	Log               *os.File           // Open file buffer that's written to
 	LogPath           string             // Path to the log file so the buffer will know where to write
@@ -92,6 +111,21 @@ type Container struct {
 	PushStart  time.Time // Set when the push command is sent to the Docker client
 	PushEnd    time.Time // Set when the push command receives a success signal from the Docker client
 	ImageSize  int64     // Set after the build process by the Docker client ImageList command
+	SBOMPath   string    // Set after the build process when the --sbom argument is used
+
+	// Set during the build from the "Step" lines of the Docker build output
+	BuildStep  string // Step of the Dockerfile, such as 7/20
+	BuildLayer string // The roles of the step's RUN layer, or the step's instruction
+
+	// Set by the vulnerability scan when the --scanner argument is used
+	ScanCounts map[string]int // Number of findings of each severity
+
+	// Set after the push process
+	Digest          string // Digest of the image manifest in the registry
+	SignatureDigest string // Digest of the image's signature in the registry, when the --sign-key argument is used
+
+	// Set when the status is changed to Failed, such as a build that timed out
+	FailureReason string
 }
 
 // ContainerConfig each container has a configmap which define Docker layers.
@@ -107,6 +141,13 @@ type ContainerConfig struct {
 	Roles       []string `yaml:"roles"`
 	Volumes     []string `yaml:"volumes"`
 
+	// Extra paths copied from the builder stage into the final image when
+	// the --multi-stage argument is used (see finalStagePaths)
+	FinalStage []string `yaml:"final_stage"`
+
+	// How the roles are split into RUN layers: per-role, grouped, or single
+	LayerStrategy string `yaml:"layer_strategy"`
+
 	// Used in the Kubernetes manifest generation
 	Resources struct {
 		Limits   []string `yaml:"limits"`
@@ -116,16 +157,26 @@ type ContainerConfig struct {
 
 // effectedImage holdes the docker file that will need to be applied to the container
 type effectedImage struct {
-	Dockerfiles []string
+	Dockerfiles []string          `yaml:"dockerfiles"`
+	Args        map[string]string `yaml:"args"` // Overrides the default value of an ARG in the addon's Dockerfiles
+
+	// Merged into the image's ContainerConfig
+	Environment []string `yaml:"environment"`
+	Volumes     []string `yaml:"volumes"`
+	Ports       []string `yaml:"ports"`
+
+	// Merged into the image's Kubernetes deployment by order.GenerateManifests
+	Kubernetes AddonKubernetes `yaml:"kubernetes"`
 }
 
 // Provide a human readable output of a container's configurations
 func (config *ContainerConfig) String() string {
-	return fmt.Sprintf("\n\n[CONFIGURATION]\n[User] %s\n[Ports] %s\n[Environment] %s\n[Roles] %s\n[Volumes] %s\n[Resources Limits] %s\n[Resources Requests] %s\n\n",
+	return fmt.Sprintf("\n\n[CONFIGURATION]\n[User] %s\n[Ports] %s\n[Environment] %s\n[Roles] %s\n[Layer Strategy] %s\n[Volumes] %s\n[Resources Limits] %s\n[Resources Requests] %s\n\n",
 		config.User+", ",
 		strings.Join(config.Ports, ", "),
 		strings.Join(config.Environment, ", "),
 		strings.Join(config.Roles, ", "),
+		config.LayerStrategy,
 		strings.Join(config.Volumes, ", "),
 		strings.Join(config.Resources.Limits, ", "),
 		strings.Join(config.Resources.Requests, ", "),
@@ -137,6 +188,9 @@ type DockerResponse struct {
 	Stream string      `json:"stream"`      // Shows up in an Image Build response
 	Status string      `json:"status"`      // Shows up in an Image Push response
 	Error  interface{} `json:"errorDetail"` // Only shows if there's an error image build response
+	Aux    struct {
+		Digest string `json:"Digest"` // Shows up at the end of an Image Push response
+	} `json:"aux"`
 }
 
 // WriteLog writes any number of object info to the container's log file
@@ -161,16 +215,26 @@ func (container *Container) GetName() string {
 	return container.SoftwareOrder.ProjectName + "-" + strings.ToLower(container.Name)
 }
 
+// addonImageName gets the name that addon_config.yml files use for the container.
+// The single container is listed by its whole name, such as sas-viya-single-programming-only.
+func (container *Container) addonImageName() string {
+	if container.SoftwareOrder.DeploymentType == "single" {
+		return container.GetName()
+	}
+	return container.Name
+}
+
 // GetTag gets the <recipe_version>-<date>-<time> format
 func (container *Container) GetTag() string {
-	// Use the "--tag" argument if provided
-	if len(container.SoftwareOrder.TagOverride) > 0 {
-		return container.SoftwareOrder.TagOverride
-	}
+	return container.SoftwareOrder.GetTag()
+}
 
-	return fmt.Sprintf("%s-%s",
-		strings.TrimSpace(RecipeVersion),
-		container.SoftwareOrder.TimestampTag)
+// getRepository gets the <namespace>/<project_name>-<container_name> repository of the image in the registry
+func (container *Container) getRepository() string {
+	if len(container.SoftwareOrder.DockerNamespace) == 0 {
+		return container.GetName()
+	}
+	return container.SoftwareOrder.DockerNamespace + "/" + container.GetName()
 }
 
 // GetWholeImageName gets a <registry>/<namespace>/<project_name>-<container_name>
@@ -266,6 +330,28 @@ func (container *Container) GetConfig() error {
 		targetConfig.Resources.Requests = append(targetConfig.Resources.Requests, "memory=2Gi")
 	}
 
+	// Default layer strategy
+	switch targetConfig.LayerStrategy {
+	case "":
+		targetConfig.LayerStrategy = LayerPerRole
+	case LayerPerRole, LayerGrouped, LayerSingle:
+	default:
+		return fmt.Errorf("Invalid layer_strategy '%s' for %s in %s. Choose between %s, %s, or %s",
+			targetConfig.LayerStrategy, container.Name, container.SoftwareOrder.ConfigPath,
+			LayerPerRole, LayerGrouped, LayerSingle)
+	}
+
+	// Addon fragments: extra environment variables, volumes, and ports
+	for _, addon := range container.SoftwareOrder.Addons {
+		image, found := addon.Images[container.addonImageName()]
+		if !found {
+			continue
+		}
+		targetConfig.Environment = append(targetConfig.Environment, image.Environment...)
+		targetConfig.Volumes = append(targetConfig.Volumes, image.Volumes...)
+		targetConfig.Ports = append(targetConfig.Ports, image.Ports...)
+	}
+
 	// Default runuser
 	// If no "user" attribute is specified in the config file then the
 	// container will run as the sas user by default.
@@ -280,8 +366,14 @@ func (container *Container) GetConfig() error {
 
 // File is used by the Container struct to create a filesystem tree
 type File struct {
-	Name    string
-	Content []byte
+	Name     string
+	Content  []byte // Generated content, such as the Dockerfile. Files from the build machine are read from Source
+	Source   string // Path on the build machine, which is read again when the context is streamed
+	Size     int64
+	Hash     string // sha256 of the content
+	Mode     int64  // Permissions of the file in the Docker context
+	Type     byte   // tar.TypeReg, tar.TypeDir, or tar.TypeSymlink
+	Linkname string // Target of a symlink, relative to the symlink's directory
 }
 
 // Prebuild performs all pre-build steps after the playbook has been parsed
@@ -300,6 +392,10 @@ func (container *Container) Prebuild(progress chan string) error {
 	if err != nil {
 		return err
 	}
+	err = container.ComputeFingerprint()
+	if err != nil {
+		return err
+	}
 
 	container.Status = Loaded
 	return nil
@@ -314,17 +410,135 @@ func (container *Container) GetBuildArgs() {
 	buildArgs["PLAYBOOK_SRV"] = &container.SoftwareOrder.CertBaseURL
 	buildArgs["SAS_RPM_REPO_URL"] = &container.SoftwareOrder.MirrorURL
 
+	// Parameters of the addons that apply to this image
+	for _, addon := range container.SoftwareOrder.Addons {
+		if _, found := addon.Images[container.addonImageName()]; !found {
+			continue
+		}
+		for name := range addon.Values {
+			value := addon.Values[name]
+			buildArgs[name] = &value
+		}
+	}
+
 	container.WriteLog(container.BuildArgs)
 	container.BuildArgs = buildArgs
 }
 
-// Build interfaces with the Docker client to run an image build
-func (container *Container) Build(progress chan string) error {
-	// Open the context payload created in pre-build so it can be passed to the Docker client
-	dockerBuildContext, err := os.Open(container.DockerContextPath)
+// RecipeSourceURL is where the SAS Container Recipes project is published
+const RecipeSourceURL = "https://github.com/sassoftware/sas-container-recipes"
+
+// GetLabels gets the labels that describe how the image was built. The
+// org.opencontainers.image labels follow the OCI image annotations spec.
+// Labels without a value, such as the revision when git is not available, are left out.
+func (container *Container) GetLabels() map[string]string {
+	labels := map[string]string{
+		"org.opencontainers.image.created":   container.SoftwareOrder.StartTime.UTC().Format(time.RFC3339),
+		"org.opencontainers.image.version":   container.GetTag(),
+		"org.opencontainers.image.revision":  container.SoftwareOrder.GitSHA,
+		"org.opencontainers.image.source":    RecipeSourceURL,
+		"org.opencontainers.image.base.name": container.SoftwareOrder.BaseImage,
+		"sas.recipe.order":                   container.SoftwareOrder.OrderNumber,
+		"sas.recipe.deployment.type":         container.SoftwareOrder.DeploymentType,
+		"sas.recipe.roles":                   strings.Join(container.Config.Roles, ","),
+	}
+
+	addons := []string{}
+	for _, addon := range container.SoftwareOrder.Addons {
+		if _, found := addon.Images[container.addonImageName()]; found {
+			addons = append(addons, addon.Name)
+		}
+	}
+	labels["sas.recipe.addons"] = strings.Join(addons, ",")
+
+	for name, value := range labels {
+		if len(value) == 0 {
+			delete(labels, name)
+		}
+	}
+	return labels
+}
+
+// runInImage runs a command in a temporary container of the image, as the image's own user if the user is
+// not set, and gets the command's exit code and output. The output includes stderr.
+func (container *Container) runInImage(imageName string, command []string, user string) (int64, []byte, error) {
+	ctx := container.SoftwareOrder.BuildContext
+	created, err := container.DockerClient.ContainerCreate(ctx,
+		&dockercontainer.Config{
+			Image:      imageName,
+			Entrypoint: command[:1],
+			Cmd:        command[1:],
+			User:       user,
+			Tty:        true, // The output is not multiplexed with stderr
+		}, nil, nil, nil, "")
 	if err != nil {
-		return err
+		return 0, nil, err
+	}
+	defer container.DockerClient.ContainerRemove(ctx, created.ID, types.ContainerRemoveOptions{Force: true})
+
+	err = container.DockerClient.ContainerStart(ctx, created.ID, types.ContainerStartOptions{})
+	if err != nil {
+		return 0, nil, err
+	}
+	exitCode := int64(0)
+	statusChannel, errorChannel := container.DockerClient.ContainerWait(ctx, created.ID, dockercontainer.WaitConditionNotRunning)
+	select {
+	case err := <-errorChannel:
+		return 0, nil, err
+	case status := <-statusChannel:
+		exitCode = status.StatusCode
+	}
+
+	logs, err := container.DockerClient.ContainerLogs(ctx, created.ID, types.ContainerLogsOptions{ShowStdout: true})
+	if err != nil {
+		return 0, nil, err
+	}
+	defer logs.Close()
+	output, err := ioutil.ReadAll(logs)
+	return exitCode, output, err
+}
+
+// SetFailed sets the container's status to Failed with the error as the reason
+func (container *Container) SetFailed(err error) {
+	container.Status = Failed
+	container.FailureReason = err.Error()
+	container.WriteLog("Failed: " + container.FailureReason)
+	container.SoftwareOrder.Progress.Update(container)
+}
+
+// dockerCallContext gets a context for a Docker build or push. It is cancelled with the
+// build, and after the timeout when the timeout is set.
+func (container *Container) dockerCallContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(container.SoftwareOrder.BuildContext, timeout)
+	}
+	return context.WithCancel(container.SoftwareOrder.BuildContext)
+}
+
+// dockerCallError describes why a Docker build or push was stopped by its context,
+// otherwise it returns the error of the call
+func dockerCallError(ctx context.Context, operation string, timeout time.Duration, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("timed out: the %s took longer than %s", operation, timeout)
+	case context.Canceled:
+		return fmt.Errorf("cancelled: the %s was stopped", operation)
 	}
+	return err
+}
+
+// Build interfaces with the Docker client to run an image build
+func (container *Container) Build(progress chan string) error {
+	ctx, cancel := container.dockerCallContext(container.SoftwareOrder.BuildTimeout)
+	defer cancel()
+
+	// Stream the context payload created in pre-build to the Docker client
+	// instead of reading a tar file from disk
+	dockerBuildContext, contextWriter := io.Pipe()
+	go func() {
+		contextWriter.CloseWithError(container.writeContextTar(contextWriter))
+	}()
+	defer dockerBuildContext.Close()
 
 	// Set the payload to send to the Docker client
 	container.GetBuildArgs()
@@ -335,6 +549,7 @@ func (container *Container) Build(progress chan string) error {
 		Tags:        []string{container.GetWholeImageName()},
 		Dockerfile:  "Dockerfile",
 		BuildArgs:   container.BuildArgs,
+		Labels:      container.GetLabels(),
 		Remove:      true,
 		ForceRemove: true,
 		ExtraHosts:  extraHosts,
@@ -344,14 +559,21 @@ func (container *Container) Build(progress chan string) error {
 	container.WriteLog("----- Starting Docker Build -----")
 	progress <- "Starting Docker build: " + container.GetWholeImageName() + " ... "
 	buildResponseStream, err := container.DockerClient.ImageBuild(
-		container.SoftwareOrder.BuildContext,
+		ctx,
 		dockerBuildContext,
 		buildOptions)
 	if err != nil {
-		return err
+		return dockerCallError(ctx, "build", container.SoftwareOrder.BuildTimeout, err)
 	}
-	return readDockerStream(buildResponseStream.Body,
+	err = readDockerStream(buildResponseStream.Body,
 		container, container.SoftwareOrder.Verbose, progress)
+
+	// The files of the context are no longer needed once the daemon has the whole context
+	container.ContextFiles = nil
+	if err != nil {
+		return dockerCallError(ctx, "build", container.SoftwareOrder.BuildTimeout, err)
+	}
+	return nil
 }
 
 // Push the image to the docker registry that's defined in the software order's attributes
@@ -368,15 +590,29 @@ func (container *Container) Push(progress chan string) error {
 	}
 
 	container.Status = Pushing
+	container.SoftwareOrder.Progress.Update(container)
 	container.WriteLog("----- Starting Docker Push -----")
 	progress <- "Pushing to Docker registry: " + container.GetWholeImageName() + " ... "
-	pushResponseStream, err := container.DockerClient.ImagePush(container.SoftwareOrder.BuildContext,
-		container.GetWholeImageName(), types.ImagePushOptions{RegistryAuth: container.SoftwareOrder.RegistryAuth})
+	// The push timeout includes the retries. The layers that were pushed by an attempt are not pushed again.
+	ctx, cancel := container.dockerCallContext(container.SoftwareOrder.PushTimeout)
+	defer cancel()
+	logAttempt := func(message string) {
+		container.WriteLog(message)
+		progress <- message
+	}
+	err := container.SoftwareOrder.RetryPolicy().Do(ctx, "push of "+container.GetWholeImageName(), logAttempt, func() error {
+		pushResponseStream, err := container.DockerClient.ImagePush(ctx,
+			container.GetWholeImageName(), types.ImagePushOptions{RegistryAuth: container.SoftwareOrder.RegistryAuth})
+		if err != nil {
+			return err
+		}
+		return readDockerStream(pushResponseStream, container,
+			container.SoftwareOrder.Verbose, progress)
+	})
 	if err != nil {
-		return err
+		return dockerCallError(ctx, "push", container.SoftwareOrder.PushTimeout, err)
 	}
-	return readDockerStream(pushResponseStream, container,
-		container.SoftwareOrder.Verbose, progress)
+	return nil
 }
 
 // readDockerStream is a helper function for container.Build and container.Push
@@ -394,19 +630,35 @@ func readDockerStream(responseStream io.ReadCloser,
 			if err == io.EOF {
 				break
 			}
+			// Such as the connection that is closed when the build is cancelled
+			return err
 		}
 
 		// The raw response is noisy with lots of spaces, so trim the spacing
 		// and print it to standard output
 		response.Stream = strings.TrimSpace(string(response.Stream))
 		responses = append(responses, *response)
+		if len(response.Aux.Digest) > 0 {
+			container.Digest = response.Aux.Digest
+		}
 		container.WriteLog(response)
+		if step, layer, found := parseBuildStep(response.Stream); found {
+			container.BuildStep = step
+			container.BuildLayer = layer
+			container.SoftwareOrder.Progress.Update(container)
+
+			// Without the whole build output the start of each role layer is shown as a log line
+			view := container.SoftwareOrder.Progress
+			if !verbose && progress != nil && (view == nil || !view.Interactive) && dockerBuildRole.MatchString(response.Stream) {
+				progress <- fmt.Sprintf("%s: step %s, %s", container.Name, step, layer)
+			}
+		}
 		if verbose && len(response.Stream) > 0 {
 			if progress != nil {
-				progress <- container.Name + ":\n" + response.Stream
+				progress <- prefixLines(container.Name+": ", response.Stream)
 			} else {
 				// Work-around to allow single container to build without a progress stream
-				log.Println(response.Stream)
+				container.SoftwareOrder.Progress.Message(response.Stream)
 			}
 		}
 		if response.Error != nil {
@@ -419,6 +671,25 @@ func readDockerStream(responseStream io.ReadCloser,
 	return nil
 }
 
+// readDockerPullStream reads the response stream of an image pull. The pull is only
+// finished, and the image is only on the build machine, once the stream has been read.
+func readDockerPullStream(responseStream io.ReadCloser) error {
+	defer responseStream.Close()
+	d := json.NewDecoder(responseStream)
+	for {
+		response := DockerResponse{}
+		if err := d.Decode(&response); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if response.Error != nil {
+			return fmt.Errorf("%v", response.Error)
+		}
+	}
+}
+
 const dockerfileFromBase = `# Generated Dockerfile for %s
 FROM %s
 ARG PLATFORM
@@ -445,11 +716,75 @@ USER %s:%s
 ENTRYPOINT ["/usr/bin/tini", "--", "/opt/sas/viya/home/bin/%s-entrypoint.sh"]
 `
 
-// Each Ansible role is a RUN layer
-const dockerfileRunLayer = `# %s role
-RUN ansible-playbook -vv /ansible/playbook.yml --extra-vars layer=%s --extra-vars PLAYBOOK_SRV=${PLAYBOOK_SRV} --extra-vars container_name=%s
+// Each Ansible role is a RUN layer, unless the container's layer strategy groups them
+const dockerfileRunLayer = `# %s
+RUN %s
+`
+
+const dockerfileRunRole = "ansible-playbook -vv /ansible/playbook.yml --extra-vars layer=%s --extra-vars PLAYBOOK_SRV=${PLAYBOOK_SRV} --extra-vars container_name=%s"
+
+// Layer strategies set by "layer_strategy" in the config yaml
+const (
+	LayerPerRole = "per-role" // Default, one RUN layer per role which gives the best cache reuse
+	LayerGrouped = "grouped"  // The shared base roles in one layer and the service roles in another
+	LayerSingle  = "single"   // All roles in one RUN layer for the smallest pull size
+)
+
+// baseRoles are shared by most images. The grouped layer strategy
+// puts the leading base roles of a container into one layer.
+var baseRoles = []string{
+	"tini", "sas-prerequisites", "sas-install-base-packages", "sas-java", "sas-install-spre",
+}
+
+// Name of the stage that runs the Ansible roles in a multi-stage build
+const builderStageName = "builder"
+
+// Directory of the builder stage that holds the files of the packages that the roles and addons installed
+const runtimePackagesPath = "/runtime-packages"
+
+// The last step of the builder stage in a multi-stage build removes Ansible and collects the files
+// of every package that is not in the base image, or is a newer version than the base image's,
+// along with the rpmdb. The base image's rpmdb is copied from the image to compare against.
+const dockerfileCollectPackages = `# Collect the packages that were installed in the builder stage, without Ansible
+USER root
+COPY --from=%s /var/lib/rpm /tmp/base-rpmdb
+RUN if [ "$PLATFORM" = "redhat" ]; then \
+        yum remove --assumeyes --setopt=clean_requirements_on_remove=1 ansible; \
+    elif [ "$PLATFORM" = "suse" ]; then \
+        zypper --non-interactive remove --clean-deps ansible; \
+    fi && \
+    rpm --query --all --dbpath /tmp/base-rpmdb | sort > /tmp/base-packages && \
+    rpm --query --all | sort | comm -13 /tmp/base-packages - > /tmp/runtime-packages && \
+    xargs --no-run-if-empty rpm --query --list < /tmp/runtime-packages | \
+        while read -r file; do if [ -e "$file" ] || [ -L "$file" ]; then echo "$file"; fi; done > /tmp/runtime-files && \
+    mkdir --parents %s/var/lib && \
+    tar --create --no-recursion --files-from /tmp/runtime-files --file - | tar --extract --directory %s --file - && \
+    cp --archive /var/lib/rpm %s/var/lib/
+`
+
+// The final stage of a multi-stage build starts from the base image so its layers are shared,
+// and Ansible, the roles, and any package manager caches are left behind
+const dockerfileFinalStage = `# Final image, built from the %s stage without Ansible or the build tooling
+FROM %s
+ARG PLATFORM
+ENV PLATFORM=$PLATFORM
 `
 
+const dockerfileCopyFromBuilder = `COPY --from=%s %s %s
+`
+
+// finalStagePaths are always carried over from the builder stage.
+// Anything else a service needs at runtime is set by "final_stage" in the config yaml.
+var finalStagePaths = []string{
+	"/opt/sas",
+	"/usr/bin/tini",
+	"/etc/passwd",
+	"/etc/group",
+	"/etc/shadow",
+	"/etc/init.d",
+	"/etc/sysconfig/sas",
+}
+
 const dockerfileAddDynamicRole = `# Add the %s specific role
 ADD dynamicRoles /ansible/dynamicRoles
 `
@@ -465,15 +800,55 @@ LABEL sas.recipe="true" \
 // CreateDockerfile creates a Dockerfile by reading the container's configuration
 func (container *Container) CreateDockerfile() (string, error) {
 	// Grab the config and start formatting the Dockerfile
-	dockerfile := fmt.Sprintf(dockerfileFromBase, container.SoftwareOrder.ProjectName+"-"+container.Name, container.BaseImage) + "\n"
+	// In a multi-stage build the roles run in a named builder stage
+	fromImage := container.BaseImage
+	if container.SoftwareOrder.MultiStage {
+		fromImage += " AS " + builderStageName
+	}
+	dockerfile := fmt.Sprintf(dockerfileFromBase, container.SoftwareOrder.ProjectName+"-"+container.Name, fromImage) + "\n"
 
-	// For each role add to the result. Also add the container.Name role (self).
+	// For each layer of roles add to the result. Also add the container.Name role (self).
 	dockerfile += "\n# Generated image includes the following Ansible roles, with the "
-	for _, role := range container.Config.Roles {
-		if strings.EqualFold(container.Name, role) {
-			dockerfile += fmt.Sprintf(dockerfileAddDynamicRole, role) + "\n"
+	for _, layer := range container.GetRoleLayers() {
+		commands := []string{}
+		for _, role := range layer {
+			if strings.EqualFold(container.Name, role) {
+				dockerfile += fmt.Sprintf(dockerfileAddDynamicRole, role) + "\n"
+			}
+			commands = append(commands, fmt.Sprintf(dockerfileRunRole, role, container.Name))
 		}
-		dockerfile += fmt.Sprintf(dockerfileRunLayer, role, role, container.Name) + "\n"
+		comment := strings.Join(layer, ", ") + " role"
+		if len(layer) > 1 {
+			comment += "s"
+		}
+		dockerfile += fmt.Sprintf(dockerfileRunLayer, comment, strings.Join(commands, " && \\\n    ")) + "\n"
+	}
+
+	// Handle AddOns Dockerfile lines
+	addonLines, warnings, err := appendAddonLines(container.addonImageName(), "", container.SoftwareOrder.Addons)
+	if err != nil {
+		return dockerfile, err
+	}
+	for _, warning := range warnings {
+		container.SoftwareOrder.WriteLog(true, warning)
+	}
+
+	// In a multi-stage build the addons run in the builder stage. The final stage starts from the
+	// base image and gets the installed packages, the installed software, and the addons' settings.
+	if container.SoftwareOrder.MultiStage {
+		dockerfile += addonLines + "\n\n"
+		dockerfile += fmt.Sprintf(dockerfileCollectPackages, container.BaseImage,
+			runtimePackagesPath, runtimePackagesPath, runtimePackagesPath) + "\n"
+		dockerfile += fmt.Sprintf(dockerfileFinalStage, builderStageName, container.BaseImage)
+		dockerfile += fmt.Sprintf(dockerfileCopyFromBuilder, builderStageName, runtimePackagesPath+"/", "/")
+		for _, path := range append(finalStagePaths, container.Config.FinalStage...) {
+			dockerfile += fmt.Sprintf(dockerfileCopyFromBuilder, builderStageName, path, path)
+		}
+		addonLines, err = addonSettingLines(addonLines)
+		if err != nil {
+			return dockerfile, err
+		}
+		dockerfile += "\n"
 	}
 
 	// Add the provided volumes
@@ -505,104 +880,97 @@ func (container *Container) CreateDockerfile() (string, error) {
 		dockerfile += fmt.Sprintf("EXPOSE %s\n", volume)
 	}
 
-	// Handle AddOns Dockerfile lines
-	dockerfile, err := appendAddonLines(container.Name, dockerfile, container.SoftwareOrder.DeploymentType, container.SoftwareOrder.AddOns)
-	if err != nil {
-		return dockerfile, err
-	}
+	dockerfile += addonLines
 
 	dockerfile += "\n" + fmt.Sprintf(dockerfileSetupEntrypoint, container.Config.User, container.Config.User, container.Name)
 	dockerfile += "\n" + fmt.Sprintf(dockerfileLabels, RecipeVersion, container.Name, container.Name)
 	return dockerfile, nil
 }
 
-// readAddonConf reads the yaml file and return the data.
-func readAddonConf(fileName string) (map[string]effectedImage, error) {
-
-	imageData := make(map[string]effectedImage)
-
-	yamlFile, err := ioutil.ReadFile(fileName)
-	if err != nil {
-		return imageData, err
+// GetRoleLayers splits the container's roles into the RUN layers
+// defined by the container's layer strategy
+func (container *Container) GetRoleLayers() [][]string {
+	roles := container.Config.Roles
+	layers := [][]string{}
+	switch container.Config.LayerStrategy {
+	case LayerSingle:
+		layers = append(layers, roles)
+	case LayerGrouped:
+		// Only the leading base roles are grouped so the role order is kept
+		baseCount := 0
+		for _, role := range roles {
+			if !stringInSlice(role, baseRoles) {
+				break
+			}
+			baseCount++
+		}
+		if baseCount > 0 {
+			layers = append(layers, roles[:baseCount])
+		}
+		if baseCount < len(roles) {
+			layers = append(layers, roles[baseCount:])
+		}
+	default:
+		for _, role := range roles {
+			layers = append(layers, []string{role})
+		}
 	}
-	err = yaml.Unmarshal(yamlFile, &imageData)
-	if err != nil {
-		return imageData, err
+	return layers
+}
+
+// stringInSlice reports whether the value is in the list
+func stringInSlice(value string, list []string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
 	}
+	return false
+}
+
+// Instructions from an addon's Dockerfile that are merged into the generated Dockerfile
+var addonSupportedInstructions = []string{
+	"RUN", "ADD", "COPY", "ARG", "ENV", "LABEL", "EXPOSE", "VOLUME", "WORKDIR", "USER",
+}
 
-	return imageData, nil
+// Instructions from an addon's Dockerfile that are skipped with a warning
+var addonIgnoredInstructions = []string{
+	"MAINTAINER", "HEALTHCHECK", "STOPSIGNAL", "ONBUILD",
 }
 
 // appendAddonLines adds any corresponding addon lines to a Dockerfile
-// Helper function utilized by all the deployment types
-func appendAddonLines(name string, dockerfile string, deploymentType string, addons []string) (string, error) {
+// Helper function utilized by all the deployment types.
+// The warnings are about the addon instructions that were skipped.
+func appendAddonLines(name string, dockerfile string, addons []*Addon) (string, []string, error) {
 
-	// This function now reads an addon_config.yml file in the addon directory to determine
-	// which containers are affected by the Dockerfiles.
+	// The addon_config.yml of each addon was loaded by order.LoadAddons
+	// and determines which containers are affected by the Dockerfiles.
+	warnings := []string{}
 	if len(addons) > 0 {
 
 		// If we add an addon to a container then set to True and we add sas.recipe.addons=true to the image
 		labelRecipeAddons := false
 		for _, addon := range addons {
-			images, err := readAddonConf(addon + "addon_config.yml")
-			if err != nil {
-				return "", err
-			}
-
 			// If we don't find the image name listed we skip.
-			targetImage, targetFound := images[name]
-			if !targetFound {
+			targetImage, targetFound := addon.Images[name]
+			if !targetFound || len(targetImage.Dockerfiles) == 0 {
 				continue
 			}
 
 			labelRecipeAddons = true
 
-			// Read the addon's Dockerfile and only grab the RUN, ADD, COPY, USER, lines
+			// Merge the instructions of the addon's Dockerfiles
 			dockerfile += "\n# AddOn(s)"
-			dockerfile += "\n# " + addon + "\n"
-
-			// addonPath is a split out of the addon var, which includes the path to the addons.
-			addonName := filepath.Base(addon)
-
-			dockerfile += "LABEL sas.recipe.addons." + addonName + "=\"true\"\n"
+			dockerfile += "\n# " + addon.Path + "\n"
+			dockerfile += "LABEL sas.recipe.addons." + addon.Name + "=\"true\"\n"
 
-			// This will need to loop through list.
 			for _, addonDockerfile := range targetImage.Dockerfiles {
-				bytes, _ := ioutil.ReadFile(addon + addonDockerfile)
-				lines := strings.Split(string(bytes), "\n")
-				endsWithSlashRe := regexp.MustCompile("\\\\s*")
-				for index, line := range lines {
-					line = strings.TrimSpace(line)
-					if len(line) == 0 {
-						continue
-					}
-
-					if strings.HasPrefix(line, "RUN ") ||
-						strings.HasPrefix(line, "ADD ") ||
-						strings.HasPrefix(line, "ARG") ||
-						strings.HasPrefix(line, "WORKDIR") ||
-						strings.HasPrefix(line, "USER") ||
-						strings.HasPrefix(line, "COPY ") {
-
-						if strings.Compare(addonName, "ide-jupyter-python3") == 0 && strings.Compare(deploymentType, "single") != 0 && strings.Contains(line, "BASEIMAGE") {
-							dockerfile += "ARG BASEIMAGE=non-single-container\n"
-						} else if strings.Compare(addonName, "ide-jupyter-python3") == 0 && strings.Compare(deploymentType, "single") == 0 && strings.Contains(line, "BASEIMAGE") {
-							dockerfile += line + "\n"
-						} else {
-							dockerfile += line + "\n"
-						}
-
-						// If there's a "\" then it's a multi-line command
-						if strings.Contains(line, "\\") {
-							for _, nextLine := range lines[index+1:] {
-								dockerfile += nextLine + "\n"
-								if !endsWithSlashRe.MatchString(nextLine) {
-									break
-								}
-							}
-						}
-					}
+				lines, skipped, err := addonDockerfileLines(addon.Path+addonDockerfile, targetImage.Args)
+				if err != nil {
+					return "", warnings, err
 				}
+				dockerfile += lines
+				warnings = append(warnings, skipped...)
 			}
 		}
 		if labelRecipeAddons == true {
@@ -610,7 +978,85 @@ func appendAddonLines(name string, dockerfile string, deploymentType string, add
 		}
 	}
 
-	return dockerfile, nil
+	return dockerfile, warnings, nil
+}
+
+// Instructions of the addons that are repeated in the final stage of a multi-stage build
+var addonSettingInstructions = []string{"ARG", "ENV", "LABEL", "EXPOSE", "VOLUME", "WORKDIR"}
+
+// addonSettingLines gets the instructions of the merged addon lines that set up the image
+// instead of changing its files, which are repeated in the final stage of a multi-stage build
+func addonSettingLines(addonLines string) (string, error) {
+	instructions, err := ParseDockerfile(addonLines)
+	if err != nil {
+		return "", err
+	}
+	lines := ""
+	for _, instruction := range instructions {
+		if stringInSlice(instruction.Command, addonSettingInstructions) {
+			lines += instruction.String() + "\n"
+		}
+	}
+	if len(lines) > 0 {
+		lines = "\n# AddOn(s) settings\n" + lines
+	}
+	return lines, nil
+}
+
+// addonDockerfileLines parses an addon's Dockerfile and gets the instructions
+// that can be merged into a generated Dockerfile.
+//
+// The FROM instruction is replaced by the recipe's own base. An ARG is given
+// a new default value when the addon_config.yml sets it in the "args" section,
+// which lets one Dockerfile behave differently for each image it applies to.
+// A warning is returned for each instruction that is skipped.
+func addonDockerfileLines(dockerfilePath string, args map[string]string) (string, []string, error) {
+	warnings := []string{}
+	content, err := ioutil.ReadFile(dockerfilePath)
+	if err != nil {
+		return "", warnings, fmt.Errorf("Unable to read addon Dockerfile %s, %s", dockerfilePath, err.Error())
+	}
+	instructions, err := ParseDockerfile(string(content))
+	if err != nil {
+		return "", warnings, fmt.Errorf("Unable to parse addon Dockerfile %s, %s", dockerfilePath, err.Error())
+	}
+
+	lines := ""
+	for _, instruction := range instructions {
+		if instruction.Stage > 1 {
+			return "", warnings, fmt.Errorf("%s:%d: multi-stage addon Dockerfiles are not supported",
+				dockerfilePath, instruction.Line)
+		}
+
+		// The images are built with the classic builder, which rejects heredocs
+		if len(instruction.Heredocs) > 0 {
+			return "", warnings, fmt.Errorf("%s:%d: heredocs are not supported in addon Dockerfiles since they need BuildKit, "+
+				"use a script that is copied into the image instead", dockerfilePath, instruction.Line)
+		}
+
+		switch {
+		case instruction.Command == "FROM":
+			continue
+		case instruction.Command == "ARG":
+			if value, found := args[instruction.ArgName()]; found {
+				lines += fmt.Sprintf("ARG %s=%s\n", instruction.ArgName(), value)
+				continue
+			}
+			lines += instruction.String() + "\n"
+		case stringInSlice(instruction.Command, addonSupportedInstructions):
+			lines += instruction.String() + "\n"
+		case stringInSlice(instruction.Command, addonIgnoredInstructions):
+			warnings = append(warnings, fmt.Sprintf("WARNING: skipping the %s instruction on line %d of addon Dockerfile %s",
+				instruction.Command, instruction.Line, dockerfilePath))
+		case instruction.Command == "ENTRYPOINT" || instruction.Command == "CMD":
+			return "", warnings, fmt.Errorf("%s:%d: an addon cannot use %s since it would replace the image's entrypoint",
+				dockerfilePath, instruction.Line, instruction.Command)
+		default:
+			return "", warnings, fmt.Errorf("%s:%d: the %s instruction is not supported in addon Dockerfiles",
+				dockerfilePath, instruction.Line, instruction.Command)
+		}
+	}
+	return lines, warnings, nil
 }
 
 // CreateBuildDirectory creates a sub-directory within the builds directory, set the log path, and the Docker context path
@@ -630,15 +1076,10 @@ func (container *Container) CreateBuildDirectory() error {
 	}
 	container.Log = logFile
 
-	// Setup the docker context writer
+	// Files are collected by AddFileToContext then written by WriteDockerContext
 	buildContextTarName := "build_context.tar"
 	container.DockerContextPath = container.BuildPath + "/" + buildContextTarName
-	finalTarFile, err := os.Create(container.DockerContextPath)
-	if err != nil {
-		return err
-	}
-	container.ContextWriter = tar.NewWriter(finalTarFile)
-	container.DockerContext = finalTarFile
+	container.ContextFiles = make(map[string]File)
 	return nil
 }
 
@@ -685,7 +1126,7 @@ func (container *Container) CreateDockerContext() error {
 		internalRolePath := fmt.Sprintf("util/static-roles-%s/%s/", container.SoftwareOrder.DeploymentType, dep)
 
 		// The role exists in the static-roles directory, so copy the entire directory tree
-		err = container.AddDirectoryToContext(internalRolePath, "roles/"+dep+"/", dep)
+		err = container.AddDirectoryToContext(internalRolePath, "roles/"+dep+"/")
 		if err != nil {
 			return err
 		}
@@ -712,7 +1153,7 @@ func (container *Container) CreateDockerContext() error {
 			// If the static-role exists then copy that directory structure
 			if _, err := os.Stat(internalRolePath); !os.IsNotExist(err) {
 				// The role exists in the static-roles directory, so copy the entire directory tree
-				err = container.AddDirectoryToContext(internalRolePath, "dynamicRoles/"+dep+"/", dep)
+				err = container.AddDirectoryToContext(internalRolePath, "dynamicRoles/"+dep+"/")
 				if err != nil {
 					return err
 				}
@@ -769,33 +1210,28 @@ func (container *Container) CreateDockerContext() error {
 				}
 			}
 		}
-
-		// Add some extra variables to every role
-		otherVars := "ANSIBLE_CONTAINER: true\n"
-		otherVars += fmt.Sprintf("PROJECT_NAME: \"%s\"\n", container.SoftwareOrder.ProjectName)
-		container.AddFileToContext("extravars.yml", "extravars.yml", []byte(otherVars))
 	}
 
-	// Handle the addons -- Each addon has a config file that specifies which container it affects.
-	for _, addon := range container.SoftwareOrder.AddOns {
-		images, err := readAddonConf(addon + "addon_config.yml")
-		if err != nil {
-			return err
-		}
+	// Add some extra variables to every role
+	otherVars := "ANSIBLE_CONTAINER: true\n"
+	otherVars += fmt.Sprintf("PROJECT_NAME: \"%s\"\n", container.SoftwareOrder.ProjectName)
+	container.AddFileToContext("extravars.yml", "extravars.yml", []byte(otherVars))
 
+	// Handle the addons -- Each addon has a config file that specifies which container it affects.
+	for _, addon := range container.SoftwareOrder.Addons {
 		// If we don't find the image name listed we skip.
-		_, targetFound := images[container.Name]
+		_, targetFound := addon.Images[container.addonImageName()]
 		if !targetFound {
 			continue
 		}
 
 		// Add the files to the top level of the docker context
-		err = container.AddDirectoryToContext(addon, "", "")
+		err = container.AddDirectoryToContext(addon.Path, "")
 		if err != nil {
 			return err
 		}
 
-		container.WriteLog("includes addons", addon)
+		container.WriteLog("includes addons", addon.Path)
 	}
 
 	// Create the Dockerfile and add it to the root of the context
@@ -810,122 +1246,395 @@ func (container *Container) CreateDockerContext() error {
 	// TODO: workaround for spawner-config requesting items from the casserver-config role
 	//       since the programming image does not need to run ALL the casserver-config tasks
 	//       Later we should de-couple spawner-config from casserver-config
-	container.AddDirectoryToContext("util/static-roles-"+container.SoftwareOrder.DeploymentType+"/casserver-config/", "roles/casserver-config/", "casserver-config")
-	container.AddDirectoryToContext("util/static-roles-"+container.SoftwareOrder.DeploymentType+"/cloud-config/", "roles/cloud-config/", "cloud-config")
+	container.AddDirectoryToContext("util/static-roles-"+container.SoftwareOrder.DeploymentType+"/casserver-config/", "roles/casserver-config/")
+	container.AddDirectoryToContext("util/static-roles-"+container.SoftwareOrder.DeploymentType+"/cloud-config/", "roles/cloud-config/")
 
 	// Always include the sas-install role since its used by other roles
-	container.AddDirectoryToContext("util/static-roles-"+container.SoftwareOrder.DeploymentType+"/sas-install/", "roles/sas-install/", "sas-install")
+	container.AddDirectoryToContext("util/static-roles-"+container.SoftwareOrder.DeploymentType+"/sas-install/", "roles/sas-install/")
 
-	return nil
+	return container.WriteDockerContext()
 }
 
-// AddFileToContext writes to the container's tar file, provided EITHER externalPath or fileBytes
+// AddFileToContext adds a file to the container's Docker context, provided EITHER externalPath or fileBytes
 //
 // externalPath: the absolute path on the build machine
 // contextPath:  absolute path to where the file should go inside the Docker context (internal path)
 //
 // NOTE: If the path contains a directory at the end then you must append a "/"
+// NOTE: If the same contextPath is added more than once then the last one is kept
 func (container *Container) AddFileToContext(externalPath string, contextPath string, fileBytes []byte) error {
-	// If a path on the build machine is provided then read the file
-	bytes := fileBytes
-	if len(bytes) == 0 {
-		readBytes, err := ioutil.ReadFile(externalPath)
-		if err != nil {
-			return err
-		}
-		bytes = readBytes
+	if container.ContextFiles == nil {
+		return errors.New("could not create docker context. Archive context files are not set up")
+	}
+
+	if len(fileBytes) > 0 {
+		return container.addContextEntry(File{Name: contextPath, Content: fileBytes, Size: int64(len(fileBytes)),
+			Hash: fmt.Sprintf("%x", sha256.Sum256(fileBytes)), Mode: contextFileMode, Type: tar.TypeReg})
 	}
 
-	// Tell the tar writer what the next block of data is
-	header := &tar.Header{
-		// The name of the file is the FULL path
-		Name:    contextPath,
-		Size:    int64(len(bytes)),
-		Mode:    0777,
-		ModTime: time.Now(),
+	// A file on the build machine is only hashed here, its content is read again when the context is streamed
+	info, err := os.Stat(externalPath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", externalPath)
+	}
+	hash, err := fileSHA256(externalPath)
+	if err != nil {
+		return err
 	}
 
-	if container.ContextWriter == nil {
-		return errors.New("could not create docker context. Archive context writer is nil")
+	// Only the executable bit is kept so the umask of the build machine does not change the context
+	mode := int64(contextFileMode)
+	if info.Mode().Perm()&0111 != 0 {
+		mode = contextExecutableMode
 	}
-	container.ContextWriter.WriteHeader(header)
+	return container.addContextEntry(File{Name: contextPath, Source: externalPath, Size: info.Size(), Hash: hash, Mode: mode, Type: tar.TypeReg})
+}
 
-	// Write the bytes to the tar file
-	// Skip writing the file's bytes if there's no content to write (like with a directory)
-	if len(bytes) == 0 {
-		return nil
+// Open reads the content of a regular file in the Docker context
+func (file File) Open() (io.ReadCloser, error) {
+	if len(file.Source) == 0 {
+		return ioutil.NopCloser(bytes.NewReader(file.Content)), nil
+	}
+	return os.Open(file.Source)
+}
+
+// contextEntryName cleans a path inside the Docker context. The path is relative
+// to the context root, so a leading "/" is removed. A path that would be
+// outside of the context root, or is the root itself, is an error.
+func contextEntryName(contextPath string) (string, error) {
+	name := path.Clean(strings.TrimLeft(filepath.ToSlash(contextPath), "/"))
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("Docker context path '%s' is outside of the context root", contextPath)
+	}
+	if name == "." {
+		return "", fmt.Errorf("Docker context path '%s' is not a file or directory inside the context", contextPath)
+	}
+	return name, nil
+}
+
+// addContextEntry adds a file, directory, or symlink to the Docker context.
+// If the same path is added more than once then the last one is kept.
+func (container *Container) addContextEntry(file File) error {
+	if container.ContextFiles == nil {
+		return errors.New("could not create docker context. Archive context files are not set up")
 	}
-	_, err := container.ContextWriter.Write(bytes)
+	name, err := contextEntryName(file.Name)
 	if err != nil {
-		log.Println("Excluding file from context", externalPath, contextPath, err)
-		container.WriteLog("Excluding files from context", externalPath, contextPath, err)
+		return err
 	}
+	file.Name = name
+	container.ContextFiles[name] = file
 	return nil
 }
 
 // AddDirectoryToContext adds all item in a directory, and its child items, to the Docker context.
+// Each item keeps its path relative to externalPath, so externalPath/tasks/main.yml
+// is added as contextPath/tasks/main.yml.
 //
 // externalPath is the path on the build machine
-// contextPath is where the file should go inside the Docker context
-func (container *Container) AddDirectoryToContext(externalPath string, contextPath string, roleName string) error {
-	var paths []string
-
-	err := filepath.Walk(externalPath, func(path string, info os.FileInfo, err error) error {
-		if info != nil {
-			if !info.IsDir() {
-				if strings.Contains(path, "Dockerfile") || strings.Contains(path, "addon_config.yml") {
-					log.Println("Skipping adding file to "+container.Name+" Docker context: ", path)
-					return nil
-				}
-				paths = append(paths, path)
+// contextPath is where the directory should go inside the Docker context
+func (container *Container) AddDirectoryToContext(externalPath string, contextPath string) error {
+	// The .recipeignore file of each directory that is walked, which applies to the items inside of it
+	directoryIgnores := make(map[string]*RecipeIgnore)
+
+	return filepath.Walk(externalPath, func(itemPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(externalPath, itemPath)
+		if err != nil {
+			return err
+		}
+		if relativePath == "." {
+			directoryIgnores[filepath.Clean(itemPath)], err = LoadRecipeIgnore(itemPath)
+			if err != nil {
+				return err
+			}
+
+			// The root directory itself, which only has an entry when it is not the context root
+			if len(strings.Trim(contextPath, "/")) == 0 {
+				return nil
 			}
+			return container.addContextEntry(File{Name: contextPath, Mode: contextExecutableMode, Type: tar.TypeDir})
 		}
-		return nil
+		name := path.Join(filepath.ToSlash(contextPath), filepath.ToSlash(relativePath))
+
+		if container.isIgnored(name, itemPath, info.IsDir(), directoryIgnores) {
+			container.WriteLog("Ignored by " + RecipeIgnoreFileName + ": " + itemPath)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			directoryIgnores[filepath.Clean(itemPath)], err = LoadRecipeIgnore(itemPath)
+			if err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			return container.addContextEntry(File{Name: name, Mode: contextExecutableMode, Type: tar.TypeDir})
+		case info.Mode()&os.ModeSymlink != 0:
+			// Keep the symlink, as long as its target is inside of the directory being added
+			target, err := os.Readlink(itemPath)
+			if err != nil {
+				return err
+			}
+			if filepath.IsAbs(target) {
+				return fmt.Errorf("symlink %s points to the absolute path %s, which is outside of the Docker context", itemPath, target)
+			}
+			resolved := filepath.Join(filepath.Dir(relativePath), target)
+			if resolved == ".." || strings.HasPrefix(resolved, ".."+string(filepath.Separator)) {
+				return fmt.Errorf("symlink %s points to %s, which is outside of %s", itemPath, target, externalPath)
+			}
+			return container.addContextEntry(File{Name: name, Mode: 0777, Type: tar.TypeSymlink, Linkname: filepath.ToSlash(target)})
+		case !info.Mode().IsRegular():
+			container.SoftwareOrder.Progress.Message("Skipping adding special file to " + container.Name + " Docker context: " + itemPath)
+			return nil
+		case info.Name() == RecipeIgnoreFileName:
+			return nil
+		case strings.HasPrefix(info.Name(), "Dockerfile") || info.Name() == "addon_config.yml":
+			container.SoftwareOrder.Progress.Message("Skipping adding file to " + container.Name + " Docker context: " + itemPath)
+			return nil
+		}
+		return container.AddFileToContext(itemPath, name, []byte{})
 	})
-	if err != nil {
-		return err
+}
+
+// isIgnored checks an item of a directory that is added to the Docker context against the
+// .recipeignore files. The project's file is matched against the path inside the context,
+// and the file of each directory above the item, up to the added directory, is matched
+// against the path relative to that directory. An inner file overrides the outer files.
+func (container *Container) isIgnored(name string, itemPath string, isDir bool, directoryIgnores map[string]*RecipeIgnore) bool {
+	ignored, _ := container.SoftwareOrder.RecipeIgnore.Match(strings.TrimLeft(name, "/"), isDir)
+
+	ignores := []*RecipeIgnore{}
+	for directory := filepath.Dir(itemPath); ; directory = filepath.Dir(directory) {
+		ignore, walked := directoryIgnores[directory]
+		if !walked {
+			break
+		}
+		ignores = append([]*RecipeIgnore{ignore}, ignores...)
+		if directory == filepath.Dir(directory) {
+			break
+		}
+	}
+	if matched, found := MatchIgnores(ignores, itemPath, isDir); found {
+		ignored = matched
 	}
+	return ignored
+}
+
+// Permissions of the files in the Docker context
+const (
+	contextFileMode       = 0644
+	contextExecutableMode = 0755
+)
 
-	// Utilize container.AddFileToContext to add each individual file
-	for _, path := range paths {
-		innerDirectory := ""
-		// if we are adding an addon then we just want the filename
-		// Need to copy sub-directories and preserve the directory structure
-		if strings.Contains(path, "addons") {
-			dirParts := strings.Split(path, "/")
-			innerDirectory = strings.Replace(path, dirParts[0]+"/"+dirParts[1]+"/", "", -1)
-		} else {
-			// Never keep these upper level directories
-			// Always keep intermediate directories. For example,
-			//          Given external=templates/static-roles-<deployment>/sas-java, context=roles/sas-java/
-			//          roles/sas-java/main.yml should be roles/sas-java/tasks/main.yml (keep /tasks/)
-			innerDirectory = strings.Replace(path, "util/static-roles-"+container.SoftwareOrder.DeploymentType+"/"+roleName+"/", "", -1)
-			innerDirectory = strings.Replace(innerDirectory, "/internal/", "", -1)
-			innerDirectory = strings.Replace(innerDirectory, "sas_viya_playbook", "", -1)
-		}
-
-		err := container.AddFileToContext(path, contextPath+innerDirectory, []byte{})
+// contextModTime is the modification time of every file in the Docker context.
+// A fixed time, along with the sorted file names, makes the same files produce
+// the same context so the Docker layer cache can be used.
+var contextModTime = time.Unix(0, 0)
+
+// WriteDockerContext records the sha256 of the Docker context. The context is
+// streamed to the Docker daemon by Build, so the tar file is only written to
+// disk when the --keep-build-context argument is used for debugging.
+func (container *Container) WriteDockerContext() error {
+	if container.SoftwareOrder.KeepBuildContext {
+		tarFile, err := os.Create(container.DockerContextPath)
+		if err != nil {
+			return err
+		}
+		err = container.writeContextTar(tarFile)
+		if closeErr := tarFile.Close(); err == nil {
+			err = closeErr
+		}
 		if err != nil {
+			// Do not leave a tar file that is only partly written
+			os.Remove(container.DockerContextPath)
 			return err
 		}
 	}
+
+	container.ContextHash = container.contextHash()
+	if len(container.SoftwareOrder.SBOMFormat) > 0 {
+		container.ContextDigests = make(map[string]string)
+		for name, file := range container.ContextFiles {
+			if file.Type == tar.TypeReg {
+				container.ContextDigests[name] = file.Hash
+			}
+		}
+	}
+	container.WriteLog(fmt.Sprintf("Docker context: %d entries, sha256 %s", len(container.ContextFiles), container.ContextHash))
+	container.WriteLog(container.contextSizeReport())
+	if container.SoftwareOrder.KeepBuildContext {
+		container.WriteLog("Docker context kept at " + container.DockerContextPath)
+	}
 	return nil
 }
 
-// Finish shuts down open file handles and client connections
-func (container *Container) Finish() error {
-	err := container.DockerClient.Close()
+// Number of the largest files that are listed in the context size report
+const contextSizeReportFiles = 10
+
+// contextSizeReport gets the size of the Docker context, broken down by each
+// role and top level directory, and lists the largest files in the context
+func (container *Container) contextSizeReport() string {
+	totalSize := int64(0)
+	directorySizes := make(map[string]int64)
+	names := []string{}
+	for name, file := range container.ContextFiles {
+		size := file.Size
+		totalSize += size
+		names = append(names, name)
+
+		// Group the roles by their own directory, such as roles/sas-java/
+		parts := strings.Split(name, "/")
+		directory := parts[0]
+		if len(parts) > 2 && (parts[0] == "roles" || parts[0] == "dynamicRoles") {
+			directory = parts[0] + "/" + parts[1] + "/"
+		} else if len(parts) > 1 {
+			directory += "/"
+		}
+		directorySizes[directory] += size
+	}
+
+	directories := []string{}
+	for directory := range directorySizes {
+		directories = append(directories, directory)
+	}
+	sort.Slice(directories, func(i, j int) bool {
+		if directorySizes[directories[i]] == directorySizes[directories[j]] {
+			return directories[i] < directories[j]
+		}
+		return directorySizes[directories[i]] > directorySizes[directories[j]]
+	})
+	sort.Slice(names, func(i, j int) bool {
+		sizeI := container.ContextFiles[names[i]].Size
+		sizeJ := container.ContextFiles[names[j]].Size
+		if sizeI == sizeJ {
+			return names[i] < names[j]
+		}
+		return sizeI > sizeJ
+	})
+
+	report := fmt.Sprintf("Docker context size: %s\n", bytesToMB(totalSize))
+	for _, directory := range directories {
+		report += fmt.Sprintf("  %10s  %s\n", bytesToMB(directorySizes[directory]), directory)
+	}
+	report += "Largest files:\n"
+	for index, name := range names {
+		if index == contextSizeReportFiles {
+			break
+		}
+		report += fmt.Sprintf("  %10s  %s\n", bytesToMB(container.ContextFiles[name].Size), name)
+	}
+	return report
+}
+
+// writeContextTar writes the files that were added to the Docker context
+// as a tar stream, sorted by their path. The files from the build machine are
+// read while they are written, and must not have changed since they were added.
+func (container *Container) writeContextTar(writer io.Writer) error {
+	tarWriter := tar.NewWriter(writer)
+	for _, name := range container.contextNames() {
+		if err := container.SoftwareOrder.BuildContext.Err(); err != nil {
+			return err
+		}
+		file := container.ContextFiles[name]
+		header := &tar.Header{
+			// The name of the file is the FULL path
+			Name:     file.Name,
+			Size:     file.Size,
+			Mode:     file.Mode,
+			ModTime:  contextModTime,
+			Typeflag: file.Type,
+			Linkname: file.Linkname,
+		}
+		if file.Type == tar.TypeDir {
+			header.Name += "/"
+		}
+		err := tarWriter.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+		if file.Type == tar.TypeReg {
+			err = writeContextFile(tarWriter, file)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tarWriter.Close()
+}
+
+// contextNames gets the names of the entries in the Docker context in the order they are written
+func (container *Container) contextNames() []string {
+	names := []string{}
+	for name := range container.ContextFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// contextHash gets the sha256 of the Docker context from the header and the content hash of each
+// entry, which were recorded when the entry was added, so the context is not read to be hashed
+func (container *Container) contextHash() string {
+	hash := sha256.New()
+	for _, name := range container.contextNames() {
+		file := container.ContextFiles[name]
+		fmt.Fprintf(hash, "%s\x00%c\x00%o\x00%d\x00%s\x00%s\n", file.Name, file.Type, file.Mode, file.Size, file.Linkname, file.Hash)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// writeContextFile copies the content of a regular file into the tar stream
+func writeContextFile(tarWriter *tar.Writer, file File) error {
+	reader, err := file.Open()
 	if err != nil {
-		container.WriteLog("failed to close docker client", err)
 		return err
 	}
+	defer reader.Close()
 
-	err = container.Log.Close()
-	if err != nil {
-		container.WriteLog("failed to close log handle", err)
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tarWriter, hash), io.LimitReader(reader, file.Size+1))
+	if err != nil && err != tar.ErrWriteTooLong {
 		return err
 	}
+	if written != file.Size || fmt.Sprintf("%x", hash.Sum(nil)) != file.Hash {
+		return fmt.Errorf("%s changed after it was added to the Docker context", file.Source)
+	}
+	return nil
+}
+
+// Finish shuts down open file handles and client connections
+func (container *Container) Finish() error {
+	// Release the files of the Docker context
+	container.ContextFiles = nil
+
+	// A kept Docker context is only complete once its sha256 is set, see WriteDockerContext
+	if container.SoftwareOrder.KeepBuildContext && len(container.ContextHash) == 0 && len(container.DockerContextPath) > 0 {
+		os.Remove(container.DockerContextPath)
+	}
 
-	container.ContextWriter.Close()
+	if container.DockerClient != nil {
+		err := container.DockerClient.Close()
+		if err != nil {
+			container.WriteLog("failed to close docker client", err)
+			return err
+		}
+	}
+
+	if container.Log != nil {
+		err := container.Log.Close()
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -0,0 +1,264 @@
+// container_test.go
+// Tests the paths and entries that are added to a container's Docker context.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestContextEntryName(t *testing.T) {
+	tests := []struct {
+		contextPath string
+		name        string
+		err         string
+	}{
+		{contextPath: "roles/consul/tasks/main.yml", name: "roles/consul/tasks/main.yml"},
+		{contextPath: "/roles/consul", name: "roles/consul"},
+		{contextPath: "//roles//consul/", name: "roles/consul"},
+		{contextPath: "roles/./consul/../httpproxy", name: "roles/httpproxy"},
+		{contextPath: "roles/../../", err: "outside of the context root"},
+		{contextPath: "..", err: "outside of the context root"},
+		{contextPath: "../etc/passwd", err: "outside of the context root"},
+		{contextPath: "roles/../../etc/passwd", err: "outside of the context root"},
+		{contextPath: "", err: "not a file or directory inside the context"},
+		{contextPath: "/", err: "not a file or directory inside the context"},
+		{contextPath: "roles/..", err: "not a file or directory inside the context"},
+	}
+	for _, test := range tests {
+		name, err := contextEntryName(test.contextPath)
+		if !errorContains(err, test.err) {
+			t.Errorf("contextEntryName(%q) error = %v, want %q", test.contextPath, err, test.err)
+			continue
+		}
+		if name != test.name {
+			t.Errorf("contextEntryName(%q) = %q, want %q", test.contextPath, name, test.name)
+		}
+	}
+}
+
+func TestAddDirectoryToContext(t *testing.T) {
+	tests := []struct {
+		description string
+		tree        []string // Items of the added directory. "dir/" is a directory and "link -> target" is a symlink
+		contextPath string
+		entries     []string // "<type> <name>" of each entry in the context, where the type is file, dir, or link
+		err         string
+	}{
+		{
+			description: "nested directories",
+			tree:        []string{"tasks/main.yml", "templates/deep/entrypoint.j2"},
+			contextPath: "roles/consul",
+			entries: []string{
+				"dir roles/consul",
+				"dir roles/consul/tasks",
+				"file roles/consul/tasks/main.yml",
+				"dir roles/consul/templates",
+				"dir roles/consul/templates/deep",
+				"file roles/consul/templates/deep/entrypoint.j2",
+			},
+		},
+		{
+			description: "empty directories are kept",
+			tree:        []string{"files/", "vars/empty/"},
+			contextPath: "roles/consul/",
+			entries:     []string{"dir roles/consul", "dir roles/consul/files", "dir roles/consul/vars", "dir roles/consul/vars/empty"},
+		},
+		{
+			description: "context root has no entry of its own",
+			tree:        []string{"setup.sh", "files/"},
+			contextPath: "",
+			entries:     []string{"dir files", "file setup.sh"},
+		},
+		{
+			description: "absolute context path is relative to the context root",
+			tree:        []string{"setup.sh"},
+			contextPath: "/addons/hadoop",
+			entries:     []string{"dir addons/hadoop", "file addons/hadoop/setup.sh"},
+		},
+		{
+			description: "symlinks inside of the directory are kept",
+			tree:        []string{"files/setup.sh", "setup.sh -> files/setup.sh", "tasks/", "tasks/files -> ../files"},
+			contextPath: "roles/consul",
+			entries: []string{
+				"dir roles/consul",
+				"dir roles/consul/files",
+				"file roles/consul/files/setup.sh",
+				"link roles/consul/setup.sh -> files/setup.sh",
+				"dir roles/consul/tasks",
+				"link roles/consul/tasks/files -> ../files",
+			},
+		},
+		{
+			description: "symlink to a sibling of the directory",
+			tree:        []string{"tasks/", "tasks/other -> ../../other"},
+			contextPath: "roles/consul",
+			err:         "which is outside of",
+		},
+		{
+			description: "symlink to the parent of the directory",
+			tree:        []string{"parent -> .."},
+			contextPath: "roles/consul",
+			err:         "which is outside of",
+		},
+		{
+			description: "symlink to an absolute path",
+			tree:        []string{"passwd -> /etc/passwd"},
+			contextPath: "roles/consul",
+			err:         "points to the absolute path",
+		},
+		{
+			description: "context path that escapes the context root",
+			tree:        []string{"setup.sh"},
+			contextPath: "../outside",
+			err:         "outside of the context root",
+		},
+		{
+			description: "context path that escapes through its parent",
+			tree:        []string{"setup.sh"},
+			contextPath: "roles/../../outside",
+			err:         "outside of the context root",
+		},
+	}
+	for _, test := range tests {
+		directory := filepath.Join(t.TempDir(), "added")
+		createTree(t, directory, test.tree)
+		container := &Container{
+			Name:          "consul",
+			ContextFiles:  make(map[string]File),
+			SoftwareOrder: &SoftwareOrder{BuildContext: context.Background()},
+		}
+
+		err := container.AddDirectoryToContext(directory, test.contextPath)
+		if !errorContains(err, test.err) {
+			t.Errorf("%s: error = %v, want %q", test.description, err, test.err)
+			continue
+		}
+		if len(test.err) > 0 {
+			continue
+		}
+		if entries := contextEntries(container); !reflect.DeepEqual(entries, test.entries) {
+			t.Errorf("%s: entries =\n  %s\nwant\n  %s", test.description,
+				strings.Join(entries, "\n  "), strings.Join(test.entries, "\n  "))
+		}
+	}
+}
+
+// createTree creates the items of a test directory
+func createTree(t *testing.T, directory string, tree []string) {
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range tree {
+		itemPath := filepath.Join(directory, strings.SplitN(item, " -> ", 2)[0])
+		switch {
+		case strings.Contains(item, " -> "):
+			err = os.Symlink(strings.SplitN(item, " -> ", 2)[1], itemPath)
+		case strings.HasSuffix(item, "/"):
+			err = os.MkdirAll(itemPath, 0755)
+		default:
+			err = os.MkdirAll(filepath.Dir(itemPath), 0755)
+			if err == nil {
+				err = ioutil.WriteFile(itemPath, []byte(item), 0644)
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// contextEntries describes the entries of the container's Docker context, sorted by their name
+func contextEntries(container *Container) []string {
+	entries := []string{}
+	for name, file := range container.ContextFiles {
+		switch file.Type {
+		case tar.TypeDir:
+			entries = append(entries, "dir "+name)
+		case tar.TypeSymlink:
+			entries = append(entries, "link "+name+" -> "+file.Linkname)
+		default:
+			entries = append(entries, "file "+name)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.SplitN(entries[i], " ", 2)[1] < strings.SplitN(entries[j], " ", 2)[1]
+	})
+	return entries
+}
+
+// errorContains checks that err has the message, or that there is no error when the message is empty
+func errorContains(err error, message string) bool {
+	if err == nil {
+		return len(message) == 0
+	}
+	return len(message) > 0 && strings.Contains(err.Error(), message)
+}
+
+func TestWriteDockerContextHash(t *testing.T) {
+	directory := t.TempDir()
+	createTree(t, filepath.Join(directory, "added"), []string{"tasks/main.yml", "files/", "setup.sh -> tasks/main.yml"})
+	contextHash := func(keep bool, dockerfile string) string {
+		log, err := os.Create(filepath.Join(directory, "log.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer log.Close()
+		container := &Container{
+			Name:              "consul",
+			ContextFiles:      make(map[string]File),
+			DockerContextPath: filepath.Join(directory, "build_context.tar"),
+			Log:               log,
+			SoftwareOrder:     &SoftwareOrder{BuildContext: context.Background(), KeepBuildContext: keep},
+		}
+		err = container.AddDirectoryToContext(filepath.Join(directory, "added"), "roles/consul")
+		if err == nil {
+			err = container.AddFileToContext("", "Dockerfile", []byte(dockerfile))
+		}
+		if err == nil {
+			err = container.WriteDockerContext()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return container.ContextHash
+	}
+
+	hash := contextHash(false, "FROM centos")
+	if fileExists(filepath.Join(directory, "build_context.tar")) {
+		t.Errorf("the Docker context was written without --keep-build-context")
+	}
+	if again := contextHash(true, "FROM centos"); again != hash {
+		t.Errorf("the same context has the hashes %s and %s", hash, again)
+	}
+	if !fileExists(filepath.Join(directory, "build_context.tar")) {
+		t.Errorf("the Docker context was not written with --keep-build-context")
+	}
+	if changed := contextHash(false, "FROM centos:7"); changed == hash {
+		t.Errorf("a changed Dockerfile has the same context hash %s", hash)
+	}
+}
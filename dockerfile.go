@@ -0,0 +1,207 @@
+// dockerfile.go
+// Parses Dockerfiles into instructions so the Dockerfiles that are provided
+// by addons can be merged into the generated Dockerfile of each container.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DockerfileInstruction is a single instruction from a Dockerfile, such as a RUN or a COPY
+type DockerfileInstruction struct {
+	Command  string   // Upper case keyword of the instruction
+	Args     string   // Arguments with the line continuations joined and comments removed
+	Heredocs []string // Content of each heredoc that belongs to the instruction
+	Original string   // The instruction as it was written, including continuations and heredocs
+	Line     int      // Line number where the instruction starts
+	Stage    int      // Number of FROM instructions before this one, so 0 is before the first FROM
+
+	portable string // Original with each backtick continuation written with a backslash
+}
+
+// String gets the instruction in a form that can be placed into any Dockerfile
+func (instruction DockerfileInstruction) String() string {
+	if len(instruction.portable) > 0 {
+		return instruction.portable
+	}
+	return instruction.Original
+}
+
+// Matches a parser directive at the top of a Dockerfile, such as "# escape=`"
+var dockerfileDirectiveRe = regexp.MustCompile(`^#\s*([a-zA-Z][a-zA-Z0-9]*)\s*=\s*(.+?)\s*$`)
+
+// Matches a heredoc marker at the start of the text, such as <<EOF, <<-EOF, or <<"EOF"
+var dockerfileHeredocRe = regexp.MustCompile(`^<<(-?)(["']?)([a-zA-Z_][a-zA-Z0-9_]*)(["']?)`)
+
+// Instructions that support heredocs
+var dockerfileHeredocCommands = []string{"RUN", "COPY", "ADD"}
+
+// ParseDockerfile splits the Dockerfile content into instructions.
+// Comments and empty lines are dropped, line continuations are joined,
+// heredocs are kept with the instruction they belong to, and the
+// escape parser directive is honored.
+func ParseDockerfile(content string) ([]DockerfileInstruction, error) {
+	instructions := []DockerfileInstruction{}
+	lines := strings.Split(strings.Replace(content, "\r\n", "\n", -1), "\n")
+	escape := "\\"
+	stage := 0
+
+	// Parser directives are only allowed before any other comment, empty line, or instruction
+	index := 0
+	for ; index < len(lines); index++ {
+		matches := dockerfileDirectiveRe.FindStringSubmatch(strings.TrimSpace(lines[index]))
+		if matches == nil {
+			break
+		}
+		if strings.ToLower(matches[1]) == "escape" {
+			if matches[2] != "\\" && matches[2] != "`" {
+				return instructions, fmt.Errorf("line %d: invalid escape directive '%s', must be \\ or `", index+1, matches[2])
+			}
+			escape = matches[2]
+		}
+	}
+
+	for ; index < len(lines); index++ {
+		trimmed := strings.TrimSpace(lines[index])
+		if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		// Collect the instruction's lines until one does not end with the escape character
+		instruction := DockerfileInstruction{Line: index + 1}
+		original := []string{lines[index]}
+		portable := []string{lines[index]}
+		args := []string{}
+		current := trimmed
+		for {
+			continued := strings.HasSuffix(current, escape)
+			if continued {
+				current = strings.TrimSuffix(current, escape)
+				last := len(portable) - 1
+				portable[last] = strings.TrimSuffix(strings.TrimRight(portable[last], " \t"), escape) + "\\"
+			}
+			args = append(args, strings.TrimSpace(current))
+			if !continued || index+1 >= len(lines) {
+				break
+			}
+			index++
+			original = append(original, lines[index])
+			portable = append(portable, lines[index])
+			current = strings.TrimSpace(lines[index])
+
+			// Comments and empty lines inside of a continuation are removed by Docker
+			for len(current) == 0 || strings.HasPrefix(current, "#") {
+				if index+1 >= len(lines) {
+					current = ""
+					break
+				}
+				index++
+				original = append(original, lines[index])
+				portable = append(portable, lines[index])
+				current = strings.TrimSpace(lines[index])
+			}
+		}
+
+		joined := strings.TrimSpace(strings.Join(args, " "))
+		fields := strings.SplitN(joined, " ", 2)
+		instruction.Command = strings.ToUpper(fields[0])
+		if len(fields) > 1 {
+			instruction.Args = strings.TrimSpace(fields[1])
+		}
+
+		// Read the body of each heredoc that was opened by the instruction
+		if stringInSlice(instruction.Command, dockerfileHeredocCommands) {
+			for _, marker := range heredocMarkers(instruction.Args) {
+				stripTabs := marker[1] == "-"
+				word := marker[3]
+				body := []string{}
+				terminated := false
+				for index+1 < len(lines) {
+					index++
+					original = append(original, lines[index])
+					portable = append(portable, lines[index])
+					line := lines[index]
+					if stripTabs {
+						line = strings.TrimLeft(line, "\t")
+					}
+					if line == word {
+						terminated = true
+						break
+					}
+					body = append(body, line)
+				}
+				if !terminated {
+					return instructions, fmt.Errorf("line %d: heredoc '%s' is never terminated", instruction.Line, word)
+				}
+				instruction.Heredocs = append(instruction.Heredocs, strings.Join(body, "\n"))
+			}
+		}
+
+		if instruction.Command == "FROM" {
+			stage++
+		}
+		instruction.Stage = stage
+
+		// Continuations that use a backtick cannot be copied into a
+		// Dockerfile that uses the default escape character, so they are rewritten
+		instruction.Original = strings.Join(original, "\n")
+		if escape != "\\" {
+			instruction.portable = strings.Join(portable, "\n")
+		}
+		instructions = append(instructions, instruction)
+	}
+	return instructions, nil
+}
+
+// ArgName gets the name of the variable that an ARG instruction declares
+func (instruction DockerfileInstruction) ArgName() string {
+	return strings.TrimSpace(strings.SplitN(instruction.Args, "=", 2)[0])
+}
+
+// heredocMarkers finds the heredoc markers of an instruction's arguments.
+// A marker inside of quotes, such as RUN echo "a <<EOF", and a shell
+// here-string (<<<) do not open a heredoc.
+func heredocMarkers(args string) [][]string {
+	markers := [][]string{}
+	quote := byte(0)
+	for index := 0; index < len(args); index++ {
+		switch {
+		case quote != 0:
+			if args[index] == '\\' && quote == '"' {
+				index++
+			} else if args[index] == quote {
+				quote = 0
+			}
+		case args[index] == '\\':
+			index++
+		case args[index] == '"' || args[index] == '\'':
+			quote = args[index]
+		case strings.HasPrefix(args[index:], "<<<"):
+			index += 2
+		case strings.HasPrefix(args[index:], "<<"):
+			if marker := dockerfileHeredocRe.FindStringSubmatch(args[index:]); marker != nil {
+				markers = append(markers, marker)
+				index += len(marker[0]) - 1
+			}
+		}
+	}
+	return markers
+}
@@ -0,0 +1,159 @@
+// dockerfile_test.go
+// Tests the parsing of the Dockerfiles that are provided by addons.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDockerfile(t *testing.T) {
+	tests := []struct {
+		description  string
+		content      string
+		instructions []string // "<line> <stage> <command> <args>" of each instruction
+		heredocs     [][]string
+		strings      []string // String() of each instruction, when it is checked
+		err          string
+	}{
+		{
+			description:  "comments and empty lines are dropped",
+			content:      "# addon\n\nFROM centos:7\n  # indented comment\nrun yum install -y sssd\n",
+			instructions: []string{"3 1 FROM centos:7", "5 1 RUN yum install -y sssd"},
+		},
+		{
+			description: "line continuations are joined",
+			content:     "FROM centos:7\nRUN yum install -y \\\n    sssd \\\n    # a comment inside of the continuation\n\n    authconfig\nUSER sas\n",
+			instructions: []string{
+				"1 1 FROM centos:7",
+				"2 1 RUN yum install -y sssd authconfig",
+				"7 1 USER sas",
+			},
+		},
+		{
+			description:  "continuation at the end of the file",
+			content:      "FROM centos:7\nRUN echo \\",
+			instructions: []string{"1 1 FROM centos:7", "2 1 RUN echo"},
+		},
+		{
+			description: "escape directive",
+			content:     "# escape=`\nFROM centos:7\nRUN yum install -y `\n    sssd\nCOPY C:\\files\\ /tmp/\n",
+			instructions: []string{
+				"2 1 FROM centos:7",
+				"3 1 RUN yum install -y sssd",
+				"5 1 COPY C:\\files\\ /tmp/",
+			},
+			strings: []string{"FROM centos:7", "RUN yum install -y \\\n    sssd", "COPY C:\\files\\ /tmp/"},
+		},
+		{
+			description:  "directive after a comment is a comment",
+			content:      "# addon\n# escape=`\nRUN echo `\n",
+			instructions: []string{"3 0 RUN echo `"},
+		},
+		{
+			description: "invalid escape directive",
+			content:     "# escape=/\nFROM centos:7\n",
+			err:         "invalid escape directive",
+		},
+		{
+			description: "heredocs",
+			content:     "FROM centos:7\nRUN <<EOF\nyum install -y sssd\nEOF\nCOPY <<-\"CONF\" <<'MORE' /etc/\n\t[sssd]\n\tCONF\nmore\nMORE\nUSER sas\n",
+			instructions: []string{
+				"1 1 FROM centos:7",
+				"2 1 RUN <<EOF",
+				"5 1 COPY <<-\"CONF\" <<'MORE' /etc/",
+				"10 1 USER sas",
+			},
+			heredocs: [][]string{nil, {"yum install -y sssd"}, {"[sssd]", "more"}, nil},
+		},
+		{
+			description:  "heredoc marker inside of quotes",
+			content:      "RUN echo \"a <<EOF\" 'b <<EOF'\nUSER sas\n",
+			instructions: []string{"1 0 RUN echo \"a <<EOF\" 'b <<EOF'", "2 0 USER sas"},
+			heredocs:     [][]string{nil, nil},
+		},
+		{
+			description:  "shell here-string",
+			content:      "RUN cat <<<EOF\nUSER sas\n",
+			instructions: []string{"1 0 RUN cat <<<EOF", "2 0 USER sas"},
+			heredocs:     [][]string{nil, nil},
+		},
+		{
+			description:  "heredoc marker in an instruction without heredocs",
+			content:      "ENV MARKER=<<EOF\nUSER sas\n",
+			instructions: []string{"1 0 ENV MARKER=<<EOF", "2 0 USER sas"},
+			heredocs:     [][]string{nil, nil},
+		},
+		{
+			description: "heredoc that is never terminated",
+			content:     "RUN <<EOF\nyum install -y sssd\n",
+			err:         "heredoc 'EOF' is never terminated",
+		},
+		{
+			description: "stages",
+			content:     "ARG VERSION=7\nFROM centos:$VERSION AS build\nRUN make\nFROM centos:7\nCOPY --from=build /out /opt/\n",
+			instructions: []string{
+				"1 0 ARG VERSION=7",
+				"2 1 FROM centos:$VERSION AS build",
+				"3 1 RUN make",
+				"4 2 FROM centos:7",
+				"5 2 COPY --from=build /out /opt/",
+			},
+		},
+		{
+			description:  "windows line endings",
+			content:      "FROM centos:7\r\nRUN echo \\\r\n    done\r\n",
+			instructions: []string{"1 1 FROM centos:7", "2 1 RUN echo done"},
+		},
+	}
+	for _, test := range tests {
+		instructions, err := ParseDockerfile(test.content)
+		if !errorContains(err, test.err) {
+			t.Errorf("%s: error = %v, want %q", test.description, err, test.err)
+			continue
+		}
+		if len(test.err) > 0 {
+			continue
+		}
+		parsed := []string{}
+		heredocs := [][]string{}
+		texts := []string{}
+		for _, instruction := range instructions {
+			parsed = append(parsed, fmt.Sprintf("%d %d %s %s", instruction.Line, instruction.Stage, instruction.Command, instruction.Args))
+			var bodies []string
+			for _, heredoc := range instruction.Heredocs {
+				bodies = append(bodies, strings.Split(heredoc, "\n")...)
+			}
+			heredocs = append(heredocs, bodies)
+			texts = append(texts, instruction.String())
+		}
+		if !reflect.DeepEqual(parsed, test.instructions) {
+			t.Errorf("%s: instructions =\n  %s\nwant\n  %s", test.description,
+				strings.Join(parsed, "\n  "), strings.Join(test.instructions, "\n  "))
+		}
+		if test.heredocs != nil && !reflect.DeepEqual(heredocs, test.heredocs) {
+			t.Errorf("%s: heredocs = %q, want %q", test.description, heredocs, test.heredocs)
+		}
+		if test.strings != nil && !reflect.DeepEqual(texts, test.strings) {
+			t.Errorf("%s: strings = %q, want %q", test.description, texts, test.strings)
+		}
+	}
+}
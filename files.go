@@ -0,0 +1,210 @@
+// files.go
+// File system helpers for the build directory: copying files, extracting
+// the playbook archive, and pointing the builds/<deployment type> link.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// copyFile copies the content and the permissions of a regular file
+func copyFile(source string, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to copy %s to %s, %s", source, destination, err.Error())
+	}
+	return nil
+}
+
+// extractTarGz extracts the directories, regular files, symbolic links, and hard links of a tgz file into the
+// destination directory. Entries that would be written outside of the destination are rejected,
+// including the ones that go through a link that was extracted earlier, and so are the other entry types.
+func extractTarGz(archivePath string, destination string) error {
+	root, err := filepath.EvalSymlinks(destination)
+	if err != nil {
+		return err
+	}
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	gzipReader, err := gzip.NewReader(archive)
+	if err != nil {
+		return fmt.Errorf("unable to read %s, %s", archivePath, err.Error())
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read %s, %s", archivePath, err.Error())
+		}
+
+		name := path.Clean(strings.TrimLeft(header.Name, "/"))
+		if name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("the entry %s in %s is outside of the archive", header.Name, archivePath)
+		}
+		if name == "." {
+			continue
+		}
+		target := filepath.Join(destination, filepath.FromSlash(name))
+		err = checkExtractPath(root, target)
+		if err != nil {
+			return fmt.Errorf("the entry %s in %s is outside of the archive, %s", header.Name, archivePath, err.Error())
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, os.FileMode(header.Mode).Perm()|0700)
+		case tar.TypeReg, tar.TypeRegA:
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+			if err == nil {
+				// A file replaces a link that was extracted earlier instead of being written to where it points
+				if info, statErr := os.Lstat(target); statErr == nil && info.Mode()&os.ModeSymlink != 0 {
+					err = os.Remove(target)
+				}
+			}
+			if err == nil {
+				err = writeTarEntry(tarReader, target, os.FileMode(header.Mode).Perm())
+			}
+		case tar.TypeSymlink:
+			linkTarget := path.Join(path.Dir(name), header.Linkname)
+			if path.IsAbs(header.Linkname) || linkTarget == ".." || strings.HasPrefix(linkTarget, "../") {
+				return fmt.Errorf("the link %s in %s points outside of the archive", header.Name, archivePath)
+			}
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+			if err == nil {
+				os.Remove(target)
+				err = os.Symlink(header.Linkname, target)
+			}
+		case tar.TypeLink:
+			// The name of a hard link's file is relative to the archive root. Only a regular file is
+			// linked, since a link to a symlink would resolve from the hard link's own directory.
+			linkName := path.Clean(strings.TrimLeft(header.Linkname, "/"))
+			if linkName == "." || linkName == ".." || strings.HasPrefix(linkName, "../") {
+				return fmt.Errorf("the link %s in %s points outside of the archive", header.Name, archivePath)
+			}
+			linkTarget := filepath.Join(destination, filepath.FromSlash(linkName))
+			err = checkExtractPath(root, linkTarget)
+			if err != nil {
+				return fmt.Errorf("the link %s in %s points outside of the archive, %s", header.Name, archivePath, err.Error())
+			}
+			info, statErr := os.Lstat(linkTarget)
+			if statErr != nil || !info.Mode().IsRegular() {
+				return fmt.Errorf("the link %s in %s does not point to a file that was extracted before it", header.Name, archivePath)
+			}
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+			if err == nil {
+				os.Remove(target)
+				err = os.Link(linkTarget, target)
+			}
+		case tar.TypeXGlobalHeader:
+			// The archive's global PAX header, such as the commit ID written by git archive, has no file
+		default:
+			return fmt.Errorf("the entry %s in %s has the type '%c', which cannot be extracted", header.Name, archivePath, header.Typeflag)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to extract %s from %s, %s", header.Name, archivePath, err.Error())
+		}
+	}
+}
+
+// checkExtractPath checks that the directory of the target is inside of the root once the links in it
+// are followed. Only the directories that exist are followed, since the missing ones are created as directories.
+func checkExtractPath(root string, target string) error {
+	existing := filepath.Dir(target)
+	for {
+		if _, err := os.Lstat(existing); err == nil || existing == filepath.Dir(existing) {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return err
+	}
+	relativePath, err := filepath.Rel(root, resolved)
+	if err != nil {
+		return err
+	}
+	if relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s resolves to %s", existing, resolved)
+	}
+	return nil
+}
+
+// writeTarEntry writes the content of the current tar entry to a file
+func writeTarEntry(tarReader *tar.Reader, target string, mode os.FileMode) error {
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, tarReader)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// replaceSymlink points the link at the target. The new link is created beside the old one and
+// renamed over it, so the link always exists. A relative target is relative to the link's directory,
+// which keeps the link valid when the builds directory is mounted at a different path on the host.
+func replaceSymlink(target string, link string) error {
+	temporaryLink := filepath.Join(filepath.Dir(link), fmt.Sprintf(".%s-%d", filepath.Base(link), os.Getpid()))
+	os.Remove(temporaryLink)
+	err := os.Symlink(target, temporaryLink)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(temporaryLink, link)
+	if err != nil {
+		os.Remove(temporaryLink)
+		return fmt.Errorf("unable to link %s to %s, %s", link, target, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+// files_test.go
+// Tests the extraction of the playbook archive and the replacement of the build links.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// tarEntry is an entry of a test archive. A directory name ends with "/", and a link has a Linkname.
+type tarEntry struct {
+	Name     string
+	Content  string
+	Linkname string
+	Typeflag byte // Optional: used instead of the type that is found from the Name and Linkname
+}
+
+func TestExtractTarGz(t *testing.T) {
+	tests := []struct {
+		description string
+		entries     []tarEntry
+		extracted   []string // "<path>" of each file and directory, and "<path> -> <target>" of each link
+		err         string
+	}{
+		{
+			description: "directories, files, and links",
+			entries: []tarEntry{
+				{Name: "sas_viya_playbook/"},
+				{Name: "sas_viya_playbook/inventory.ini", Content: "[sas_all]"},
+				{Name: "sas_viya_playbook/roles/consul/tasks/main.yml", Content: "- name: consul"},
+				{Name: "sas_viya_playbook/site.yml", Linkname: "roles/consul/tasks/main.yml"},
+			},
+			extracted: []string{
+				"sas_viya_playbook",
+				"sas_viya_playbook/inventory.ini",
+				"sas_viya_playbook/roles",
+				"sas_viya_playbook/roles/consul",
+				"sas_viya_playbook/roles/consul/tasks",
+				"sas_viya_playbook/roles/consul/tasks/main.yml",
+				"sas_viya_playbook/site.yml -> roles/consul/tasks/main.yml",
+			},
+		},
+		{
+			description: "absolute names are relative to the destination",
+			entries:     []tarEntry{{Name: "/etc/hosts", Content: "127.0.0.1"}},
+			extracted:   []string{"etc", "etc/hosts"},
+		},
+		{
+			description: "parent directory in the name",
+			entries:     []tarEntry{{Name: "../escaped", Content: "x"}},
+			err:         "is outside of the archive",
+		},
+		{
+			description: "parent directory in the middle of the name",
+			entries:     []tarEntry{{Name: "sas_viya_playbook/../../escaped", Content: "x"}},
+			err:         "is outside of the archive",
+		},
+		{
+			description: "link to an absolute path",
+			entries:     []tarEntry{{Name: "passwd", Linkname: "/etc/passwd"}},
+			err:         "points outside of the archive",
+		},
+		{
+			description: "link to the parent of the destination",
+			entries:     []tarEntry{{Name: "sas_viya_playbook/up", Linkname: "../.."}},
+			err:         "points outside of the archive",
+		},
+		{
+			description: "chained links that lead outside of the destination",
+			entries: []tarEntry{
+				{Name: "a", Linkname: "."},
+				{Name: "a/b", Linkname: ".."},
+				{Name: "a/b/escaped", Content: "x"},
+			},
+			err: "is outside of the archive",
+		},
+		{
+			description: "directory through chained links",
+			entries: []tarEntry{
+				{Name: "a", Linkname: "."},
+				{Name: "a/b", Linkname: ".."},
+				{Name: "a/b/escaped/"},
+			},
+			err: "is outside of the archive",
+		},
+		{
+			description: "hard link to a file",
+			entries: []tarEntry{
+				{Name: "sas_viya_playbook/site.yml", Content: "- hosts: all"},
+				{Name: "sas_viya_playbook/roles/site.yml", Linkname: "sas_viya_playbook/site.yml", Typeflag: tar.TypeLink},
+			},
+			extracted: []string{"sas_viya_playbook", "sas_viya_playbook/roles", "sas_viya_playbook/roles/site.yml", "sas_viya_playbook/site.yml"},
+		},
+		{
+			description: "hard link outside of the destination",
+			entries:     []tarEntry{{Name: "passwd", Linkname: "../escaped", Typeflag: tar.TypeLink}},
+			err:         "points outside of the archive",
+		},
+		{
+			description: "hard link through chained links that lead outside of the destination",
+			entries: []tarEntry{
+				{Name: "a", Linkname: "."},
+				{Name: "a/b", Linkname: ".."},
+				{Name: "passwd", Linkname: "a/b/escaped", Typeflag: tar.TypeLink},
+			},
+			err: "points outside of the archive",
+		},
+		{
+			description: "hard link to a symlink",
+			entries: []tarEntry{
+				{Name: "a/b/link", Linkname: "../file"},
+				{Name: "link", Linkname: "a/b/link", Typeflag: tar.TypeLink},
+			},
+			err: "does not point to a file that was extracted before it",
+		},
+		{
+			description: "hard link to a missing file",
+			entries:     []tarEntry{{Name: "site.yml", Linkname: "missing.yml", Typeflag: tar.TypeLink}},
+			err:         "does not point to a file that was extracted before it",
+		},
+		{
+			description: "unsupported type",
+			entries:     []tarEntry{{Name: "fifo", Typeflag: tar.TypeFifo}},
+			err:         "which cannot be extracted",
+		},
+	}
+	for _, test := range tests {
+		directory := t.TempDir()
+		archivePath := filepath.Join(directory, "sas_viya_playbook.tgz")
+		writeTarGz(t, archivePath, test.entries)
+		destination := filepath.Join(directory, "build")
+		err := os.Mkdir(destination, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = extractTarGz(archivePath, destination)
+		if !errorContains(err, test.err) {
+			t.Errorf("%s: error = %v, want %q", test.description, err, test.err)
+			continue
+		}
+		if escaped := filepath.Join(directory, "escaped"); fileExists(escaped) {
+			t.Errorf("%s: %s was written outside of the destination", test.description, escaped)
+		}
+		if len(test.err) > 0 {
+			continue
+		}
+		if extracted := listTree(t, destination); !reflect.DeepEqual(extracted, test.extracted) {
+			t.Errorf("%s: extracted =\n  %s\nwant\n  %s", test.description,
+				strings.Join(extracted, "\n  "), strings.Join(test.extracted, "\n  "))
+		}
+	}
+}
+
+// A file replaces a link that was extracted before it, instead of being written to where the link points
+func TestExtractTarGzReplacesLink(t *testing.T) {
+	directory := t.TempDir()
+	archivePath := filepath.Join(directory, "sas_viya_playbook.tgz")
+	writeTarGz(t, archivePath, []tarEntry{
+		{Name: "site.yml", Linkname: "inventory.ini"},
+		{Name: "inventory.ini", Content: "[sas_all]"},
+		{Name: "site.yml", Content: "- hosts: all"},
+	})
+	err := extractTarGz(archivePath, directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"inventory.ini": "[sas_all]", "site.yml": "- hosts: all"} {
+		content, err := ioutil.ReadFile(filepath.Join(directory, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != want {
+			t.Errorf("%s = %q, want %q", name, content, want)
+		}
+	}
+}
+
+func TestReplaceSymlink(t *testing.T) {
+	tests := []struct {
+		description string
+		existing    string // Target of the link before it is replaced, or empty for no link
+		target      string
+	}{
+		{description: "new link", target: "build-1"},
+		{description: "existing link", existing: "build-1", target: "build-2"},
+		{description: "dangling link", existing: "missing", target: "build-2"},
+		{description: "absolute target", existing: "build-1", target: "/builds/build-2"},
+	}
+	for _, test := range tests {
+		directory := t.TempDir()
+		link := filepath.Join(directory, "multiple")
+		if len(test.existing) > 0 {
+			err := os.Symlink(test.existing, link)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := replaceSymlink(test.target, link)
+		if err != nil {
+			t.Errorf("%s: %v", test.description, err)
+			continue
+		}
+		target, err := os.Readlink(link)
+		if err != nil || target != test.target {
+			t.Errorf("%s: link points to %q (%v), want %q", test.description, target, err, test.target)
+		}
+		if items := listTree(t, directory); len(items) != 1 {
+			t.Errorf("%s: the temporary link was left behind, found %s", test.description, strings.Join(items, ", "))
+		}
+	}
+
+	// A directory cannot be replaced by a link, and the temporary link is removed
+	directory := t.TempDir()
+	link := filepath.Join(directory, "multiple")
+	createTree(t, link, []string{"log.txt"})
+	err := replaceSymlink("build-1", link)
+	if !errorContains(err, "unable to link") {
+		t.Errorf("replacing a directory: error = %v, want %q", err, "unable to link")
+	}
+	if items := listTree(t, directory); !reflect.DeepEqual(items, []string{"multiple", "multiple/log.txt"}) {
+		t.Errorf("replacing a directory left %s", strings.Join(items, ", "))
+	}
+}
+
+// writeTarGz writes the entries to a tgz file
+func writeTarGz(t *testing.T, archivePath string, entries []tarEntry) {
+	archive, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	gzipWriter := gzip.NewWriter(archive)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.Name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.Content))}
+		switch {
+		case len(entry.Linkname) > 0:
+			header = &tar.Header{Name: entry.Name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: entry.Linkname}
+		case strings.HasSuffix(entry.Name, "/"):
+			header = &tar.Header{Name: entry.Name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if entry.Typeflag != 0 {
+			header.Typeflag = entry.Typeflag
+		}
+		err = tarWriter.WriteHeader(header)
+		if err == nil && header.Typeflag == tar.TypeReg {
+			_, err = tarWriter.Write([]byte(entry.Content))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tarWriter.Close(); err == nil {
+		err = gzipWriter.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listTree lists the items under the directory, sorted by their path. A link is listed with its target.
+func listTree(t *testing.T, directory string) []string {
+	items := []string{}
+	err := filepath.Walk(directory, func(itemPath string, info os.FileInfo, err error) error {
+		if err != nil || itemPath == directory {
+			return err
+		}
+		name, err := filepath.Rel(directory, itemPath)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(itemPath)
+			if err != nil {
+				return err
+			}
+			name += " -> " + target
+		}
+		items = append(items, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(items)
+	return items
+}
+
+// fileExists checks whether there is a file, directory, or link at the path
+func fileExists(itemPath string) bool {
+	_, err := os.Lstat(itemPath)
+	return err == nil
+}
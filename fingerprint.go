@@ -0,0 +1,245 @@
+// fingerprint.go
+// Fingerprints the inputs of each image so that a '--changed-only' build
+// only builds the images whose inputs changed since the previous build.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// FingerprintFileName is written to each container's build directory with the inputs of its fingerprint.
+// Compare the files of two builds to see why an image was built again.
+const FingerprintFileName = "fingerprint.txt"
+
+// sharedRoles are in the Docker context of every image and are used by the other roles
+var sharedRoles = []string{"sas-install", "casserver-config", "cloud-config"}
+
+// includedRole matches the role name of an include_role or import_role task
+var includedRole = regexp.MustCompile(`(?m)(?:include_role|import_role):\s*\n\s*name:\s*["']?([\w.-]+)`)
+
+// ComputeFingerprint sets the sha256 of the image's inputs: the recipe version, the base image ID,
+// the build arguments, the addons, and the files of the Docker context, which include the Dockerfile
+// and the playbook's group_vars. It must be called before the Docker context is released by Build.
+func (container *Container) ComputeFingerprint() error {
+	baseImage, _, err := container.DockerClient.ImageInspectWithRaw(container.SoftwareOrder.BuildContext, container.BaseImage)
+	if err != nil {
+		return fmt.Errorf("unable to fingerprint the image, the base image %s is not on the build machine. %s",
+			container.BaseImage, err.Error())
+	}
+	inputs := []string{
+		"recipe_version " + strings.TrimSpace(RecipeVersion),
+		"base_image " + container.BaseImage + " " + baseImage.ID,
+	}
+
+	// The address of the builder changes with every build and does not change the image
+	container.GetBuildArgs()
+	for name, value := range container.BuildArgs {
+		if name != "PLAYBOOK_SRV" && value != nil {
+			inputs = append(inputs, fmt.Sprintf("build_arg %s=%s", name, *value))
+		}
+	}
+	for _, addon := range container.SoftwareOrder.Addons {
+		if _, found := addon.Images[container.addonImageName()]; found {
+			inputs = append(inputs, "addon "+addon.Name)
+		}
+	}
+
+	// Every static role is in every Docker context, so only the roles that the image runs are part of its fingerprint
+	roles, err := container.usedRoles()
+	if err != nil {
+		return err
+	}
+	for name, file := range container.ContextFiles {
+		parts := strings.SplitN(name, "/", 3)
+		if len(parts) > 1 && parts[0] == "roles" && !roles[strings.ToLower(parts[1])] {
+			continue
+		}
+		switch file.Type {
+		case tar.TypeReg:
+			inputs = append(inputs, fmt.Sprintf("file %s %o %s", name, file.Mode, file.Hash))
+		case tar.TypeSymlink:
+			inputs = append(inputs, fmt.Sprintf("link %s %s", name, file.Linkname))
+		}
+	}
+	sort.Strings(inputs)
+
+	content := strings.Join(inputs, "\n") + "\n"
+	container.Fingerprint = fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	container.WriteLog("Fingerprint: " + container.Fingerprint)
+	return ioutil.WriteFile(container.BuildPath+"/"+FingerprintFileName, []byte(content), 0644)
+}
+
+// usedRoles gets the lowercase names of the roles that the image runs, along with the shared roles
+// and the roles that those roles include
+func (container *Container) usedRoles() (map[string]bool, error) {
+	used := make(map[string]bool)
+	queue := append([]string{container.Name}, container.Config.Roles...)
+	queue = append(queue, sharedRoles...)
+	for len(queue) > 0 {
+		role := strings.ToLower(queue[0])
+		queue = queue[1:]
+		if used[role] {
+			continue
+		}
+		used[role] = true
+		for name, file := range container.ContextFiles {
+			if file.Type == tar.TypeReg && strings.HasPrefix(strings.ToLower(name), "roles/"+role+"/") {
+				content, err := readContextFile(file)
+				if err != nil {
+					return used, err
+				}
+				for _, match := range includedRole.FindAllSubmatch(content, -1) {
+					queue = append(queue, string(match[1]))
+				}
+			}
+		}
+	}
+	return used, nil
+}
+
+// readContextFile reads the whole content of a regular file in the Docker context
+func readContextFile(file File) ([]byte, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// loadPreviousBuild reads the build report of the build that builds/<deployment type> points to.
+// It must be called before the link is pointed at the new build directory.
+func (order *SoftwareOrder) loadPreviousBuild() {
+	target, err := os.Readlink("builds/" + order.DeploymentType)
+	if err != nil {
+		order.WriteLog(true, "There is no previous "+order.DeploymentType+" build, so every image will be built")
+		return
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join("builds", target)
+	}
+	report, err := readBuildReport(filepath.Join(target, BuildReportFileName))
+	if err != nil {
+		order.WriteLog(true, "Unable to read the report of the previous build, so every image will be built. "+err.Error())
+		return
+	}
+	order.PreviousBuild = report
+	order.WriteLog(true, "Images that have not changed since the "+target+" build will be tagged instead of built")
+}
+
+// RetagUnchanged tags the image of the previous build with the new tag in the registry for each container
+// whose fingerprint has not changed. Those containers are not built. A container that cannot be
+// tagged, or whose previous image does not pass the current scan, is built instead.
+func (order *SoftwareOrder) RetagUnchanged() {
+	if order.PreviousBuild == nil {
+		return
+	}
+	previousImages := make(map[string]ImageReport)
+	for _, image := range order.PreviousBuild.Images {
+		previousImages[image.Name] = image
+	}
+	registry, err := newRegistryClient(order.DockerRegistry, order.RegistryAuth)
+	if err != nil {
+		order.WriteLog(true, "Unable to connect to the Docker registry, so every image will be built. "+err.Error())
+		return
+	}
+
+	unchanged := []string{}
+	for _, container := range order.Containers {
+		if container.Status != Loaded || len(container.Fingerprint) == 0 {
+			continue
+		}
+		previous, found := previousImages[container.Name]
+		if !found || previous.Fingerprint != container.Fingerprint || len(previous.Digest) == 0 ||
+			(previous.Status != Pushed.String() && previous.Status != Retagged.String()) ||
+			imageRepository(previous.Image) != imageRepository(container.GetWholeImageName()) {
+			continue
+		}
+
+		// The SBOM is written from the local image, so an image without one is built
+		if len(order.SBOMFormat) > 0 && len(previous.SBOM) == 0 {
+			continue
+		}
+
+		// An image is only tagged if its previous scan passes the current --scan-severity
+		if order.Scanner != nil && !passesScan(previous.Vulnerabilities, order.ScanSeverity) {
+			continue
+		}
+
+		err := container.Retag(registry, previous)
+		if err != nil {
+			order.WriteLog(true, fmt.Sprintf("Unable to tag the unchanged image %s, so it will be built. %s", previous.Image, err.Error()))
+			continue
+		}
+		unchanged = append(unchanged, container.Name)
+	}
+	if len(unchanged) > 0 {
+		sort.Strings(unchanged)
+		order.WriteLog(true, "Unchanged images that were tagged instead of built: "+strings.Join(unchanged, ", "))
+	}
+}
+
+// Retag pushes the manifest of the previous build's image with the container's tag and
+// carries over the previous image's details for the build report
+func (container *Container) Retag(registry *registryClient, previous ImageReport) error {
+	repository := container.getRepository()
+	mediaType, manifest, err := registry.GetManifest(repository, previous.Digest)
+	if err != nil {
+		return err
+	}
+	digest, err := registry.PushManifest(repository, container.GetTag(), mediaType, manifest)
+	if err != nil {
+		return err
+	}
+	container.Digest = digest
+	container.ImageSize = previous.Size
+	container.SBOMPath = previous.SBOM
+	container.ScanCounts = previous.Vulnerabilities
+	container.SignatureDigest = previous.SignatureDigest
+
+	// The signature is stored by the image's digest, so only an image that was not signed before is signed
+	if container.SoftwareOrder.Signer != nil && len(container.SignatureDigest) == 0 {
+		container.SignatureDigest, err = container.SoftwareOrder.Signer.Sign(container, container.Digest)
+		if err != nil {
+			return err
+		}
+	}
+
+	container.ContextFiles = nil
+	container.Status = Retagged
+	container.WriteLog(fmt.Sprintf("Unchanged since %s, tagged %s@%s as %s", previous.Image, repository, digest, container.GetTag()))
+	return nil
+}
+
+// imageRepository gets the <registry>/<namespace>/<name> of an image name without its tag
+func imageRepository(image string) string {
+	separator := strings.LastIndex(image, ":")
+	if separator > strings.LastIndex(image, "/") {
+		return image[:separator]
+	}
+	return image
+}
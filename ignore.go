@@ -0,0 +1,228 @@
+// ignore.go
+// Reads .recipeignore files, which list the files that are left out of
+// the Docker build contexts. The files use the same pattern format as
+// a .gitignore file.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// RecipeIgnoreFileName is the name of the file that lists the paths to leave out of a Docker context
+const RecipeIgnoreFileName = ".recipeignore"
+
+// RecipeIgnore holds the patterns of a single .recipeignore file
+type RecipeIgnore struct {
+	Root  string // Directory of the .recipeignore file. Patterns are matched against paths relative to it.
+	rules []ignoreRule
+}
+
+// ignoreRule is a single line of a .recipeignore file
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool // Starts with "!", which includes a path that an earlier pattern left out
+	dirOnly bool // Ends with "/", which only matches directories
+}
+
+// LoadRecipeIgnore reads the .recipeignore file in the directory.
+// If there is no file then nil is returned, which ignores nothing.
+func LoadRecipeIgnore(directory string) (*RecipeIgnore, error) {
+	content, err := ioutil.ReadFile(filepath.Join(directory, RecipeIgnoreFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ignore := &RecipeIgnore{Root: directory}
+	for index, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := ignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, "\\#") || strings.HasPrefix(line, "\\!") {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		// A pattern with a slash is relative to the .recipeignore file,
+		// otherwise it matches a file or directory name at any depth
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		expression := globToRegexp(line)
+		if anchored {
+			expression = "^" + expression + "$"
+		} else {
+			expression = "^(.*/)?" + expression + "$"
+		}
+		rule.pattern, err = regexp.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid pattern '%s', %s",
+				filepath.Join(directory, RecipeIgnoreFileName), index+1, line, err.Error())
+		}
+		ignore.rules = append(ignore.rules, rule)
+	}
+	return ignore, nil
+}
+
+// Match checks the path, which is relative to the .recipeignore file, against each pattern.
+// The last pattern that matches decides if the path is ignored. found is false if no pattern matched.
+func (ignore *RecipeIgnore) Match(path string, isDir bool) (ignored bool, found bool) {
+	if ignore == nil {
+		return false, false
+	}
+	path = filepath.ToSlash(path)
+	for _, rule := range ignore.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.pattern.MatchString(path) {
+			ignored = !rule.negate
+			found = true
+		}
+	}
+	return ignored, found
+}
+
+// MatchIgnores checks a path against a list of .recipeignore files, from the outermost
+// directory to the innermost. A match in an inner file overrides the outer files.
+// found is false if no pattern of a file that contains the path matched.
+func MatchIgnores(ignores []*RecipeIgnore, path string, isDir bool) (ignored bool, found bool) {
+	for _, ignore := range ignores {
+		if ignore == nil {
+			continue
+		}
+		absoluteRoot, err := filepath.Abs(ignore.Root)
+		if err != nil {
+			continue
+		}
+		absolutePath, err := filepath.Abs(path)
+		if err != nil {
+			continue
+		}
+		relativePath, err := filepath.Rel(absoluteRoot, absolutePath)
+		if err != nil || relativePath == "." || relativePath == ".." ||
+			strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if matched, matchFound := ignore.Match(relativePath, isDir); matchFound {
+			ignored = matched
+			found = true
+		}
+	}
+	return ignored, found
+}
+
+// globToRegexp converts a .gitignore style pattern into a regular expression.
+// "*" and "?" do not match a "/", while "**" matches any number of directories.
+func globToRegexp(glob string) string {
+	expression := ""
+	for index := 0; index < len(glob); index++ {
+		character := glob[index]
+		switch {
+		case strings.HasPrefix(glob[index:], "**/"):
+			expression += "(.*/)?"
+			index += 2
+		case strings.HasPrefix(glob[index:], "/**") && index+3 == len(glob):
+			expression += "/.*"
+			index += 2
+		case strings.HasPrefix(glob[index:], "**"):
+			expression += ".*"
+			index++
+		case character == '*':
+			expression += "[^/]*"
+		case character == '?':
+			expression += "[^/]"
+		case character == '[':
+			class, length := globClass(glob[index:])
+			if length == 0 {
+				expression += regexp.QuoteMeta(string(character))
+				continue
+			}
+			expression += class
+			index += length - 1
+		case character == '\\' && index+1 < len(glob):
+			index++
+			expression += regexp.QuoteMeta(string(glob[index]))
+		default:
+			expression += regexp.QuoteMeta(string(character))
+		}
+	}
+	return expression
+}
+
+// globClass converts the bracket expression at the start of the glob, such as [a-z] or [!0-9],
+// into a class of a regular expression, and gets the length of the bracket expression.
+// Like .gitignore, a "]" right after the opening bracket is part of the class, a backslash
+// escapes the next character, and a negated class does not match a "/".
+// The length is 0 if the bracket is never closed, so it is matched as a "[".
+func globClass(glob string) (string, int) {
+	index := 1
+	negate := false
+	if index < len(glob) && (glob[index] == '!' || glob[index] == '^') {
+		negate = true
+		index++
+	}
+	members := ""
+	for start := index; index < len(glob); index++ {
+		character := glob[index]
+		switch {
+		case character == ']' && index > start:
+			if negate {
+				return "[^/" + members + "]", index + 1
+			}
+			return "[" + members + "]", index + 1
+		case strings.HasPrefix(glob[index:], "[:") && strings.Contains(glob[index+2:], ":]"):
+			// A character class name, such as [:digit:], is the same in a regular expression
+			end := index + 2 + strings.Index(glob[index+2:], ":]") + 2
+			members += glob[index:end]
+			index = end - 1
+		case character == '\\' && index+1 < len(glob):
+			index++
+			members += classLiteral(glob[index])
+		case character == '-':
+			members += "-"
+		default:
+			members += classLiteral(character)
+		}
+	}
+	return "", 0
+}
+
+// classLiteral escapes a character that has a meaning inside of a regular expression class
+func classLiteral(character byte) string {
+	if strings.IndexByte("\\]-[^", character) >= 0 {
+		return "\\" + string(character)
+	}
+	return string(character)
+}
@@ -0,0 +1,186 @@
+// ignore_test.go
+// Tests the matching of the .recipeignore patterns.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob      string
+		matches   []string
+		unmatched []string
+	}{
+		{glob: "*.log", matches: []string{"build.log", ".log"}, unmatched: []string{"logs/build.log", "build.log.1"}},
+		{glob: "file?.txt", matches: []string{"file1.txt"}, unmatched: []string{"file.txt", "file/.txt"}},
+		{glob: "**/cache", matches: []string{"cache", "a/cache", "a/b/cache"}, unmatched: []string{"acache"}},
+		{glob: "roles/**", matches: []string{"roles/a", "roles/a/b"}, unmatched: []string{"roles", "other/a"}},
+		{glob: "a/**/b", matches: []string{"a/b", "a/x/b", "a/x/y/b"}, unmatched: []string{"a/xb", "b"}},
+		{glob: "a**b", matches: []string{"ab", "a/x/b"}},
+		{glob: "[abc].yml", matches: []string{"a.yml", "c.yml"}, unmatched: []string{"d.yml"}},
+		{glob: "[a-c]1", matches: []string{"b1"}, unmatched: []string{"d1", "-1"}},
+		{glob: "[!a-c]1", matches: []string{"d1"}, unmatched: []string{"a1", "/1"}},
+		{glob: "[^a]1", matches: []string{"b1"}, unmatched: []string{"a1"}},
+		{glob: "[]]x", matches: []string{"]x"}, unmatched: []string{"ax"}},
+		{glob: "[!]]x", matches: []string{"ax"}, unmatched: []string{"]x"}},
+		{glob: `[\]a]x`, matches: []string{"]x", "ax"}, unmatched: []string{`\x`}},
+		{glob: `[\\]x`, matches: []string{`\x`}, unmatched: []string{"]x"}},
+		{glob: "[a-]x", matches: []string{"ax", "-x"}, unmatched: []string{"bx"}},
+		{glob: "[[]x", matches: []string{"[x"}},
+		{glob: "[^]x", matches: []string{"[^]x"}, unmatched: []string{"^x", "ax"}},
+		{glob: "[[:digit:]]x", matches: []string{"1x"}, unmatched: []string{"ax"}},
+		{glob: "[abc", matches: []string{"[abc"}, unmatched: []string{"a"}},
+		{glob: `\*.txt`, matches: []string{"*.txt"}, unmatched: []string{"a.txt"}},
+		{glob: "a.b+c", matches: []string{"a.b+c"}, unmatched: []string{"axbbc"}},
+	}
+	for _, test := range tests {
+		expression := "^" + globToRegexp(test.glob) + "$"
+		pattern, err := regexp.Compile(expression)
+		if err != nil {
+			t.Errorf("globToRegexp(%q) = %q, %v", test.glob, expression, err)
+			continue
+		}
+		for _, path := range test.matches {
+			if !pattern.MatchString(path) {
+				t.Errorf("globToRegexp(%q) = %q does not match %q", test.glob, expression, path)
+			}
+		}
+		for _, path := range test.unmatched {
+			if pattern.MatchString(path) {
+				t.Errorf("globToRegexp(%q) = %q matches %q", test.glob, expression, path)
+			}
+		}
+	}
+}
+
+func TestRecipeIgnoreMatch(t *testing.T) {
+	tests := []struct {
+		description string
+		patterns    string
+		path        string
+		isDir       bool
+		ignored     bool
+		found       bool
+	}{
+		{description: "unanchored name at the root", patterns: "*.log", path: "build.log", ignored: true, found: true},
+		{description: "unanchored name at any depth", patterns: "*.log", path: "roles/consul/build.log", ignored: true, found: true},
+		{description: "anchored with a leading slash", patterns: "/build.log", path: "roles/build.log"},
+		{description: "anchored at the root", patterns: "/build.log", path: "build.log", ignored: true, found: true},
+		{description: "anchored with a slash in the middle", patterns: "roles/*.retry", path: "roles/site.retry", ignored: true, found: true},
+		{description: "anchored pattern at another depth", patterns: "roles/*.retry", path: "a/roles/site.retry"},
+		{description: "double star directory", patterns: "**/tmp", path: "a/b/tmp", isDir: true, ignored: true, found: true},
+		{description: "double star contents", patterns: "cache/**", path: "cache/a/b", ignored: true, found: true},
+		{description: "directory only rule and a directory", patterns: "tmp/", path: "roles/tmp", isDir: true, ignored: true, found: true},
+		{description: "directory only rule and a file", patterns: "tmp/", path: "roles/tmp"},
+		{description: "negation", patterns: "*.log\n!keep.log", path: "keep.log", found: true},
+		{description: "negation of another file", patterns: "*.log\n!keep.log", path: "drop.log", ignored: true, found: true},
+		{description: "last pattern wins", patterns: "!keep.log\n*.log", path: "keep.log", ignored: true, found: true},
+		{description: "negated directory only rule", patterns: "tmp*\n!tmp/", path: "tmp", isDir: true, found: true},
+		{description: "negated directory only rule and a file", patterns: "tmp*\n!tmp/", path: "tmp", ignored: true, found: true},
+		{description: "comments and escapes", patterns: "# build.log\n\\#notes\n\\!important", path: "#notes", ignored: true, found: true},
+		{description: "comment is not a pattern", patterns: "# build.log", path: "# build.log"},
+		{description: "escaped exclamation mark", patterns: "\\!important", path: "!important", ignored: true, found: true},
+		{description: "trailing spaces are removed", patterns: "build.log  \r\n", path: "build.log", ignored: true, found: true},
+		{description: "no match", patterns: "*.log", path: "site.yml"},
+	}
+	for _, test := range tests {
+		directory := t.TempDir()
+		err := ioutil.WriteFile(filepath.Join(directory, RecipeIgnoreFileName), []byte(test.patterns), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ignore, err := LoadRecipeIgnore(directory)
+		if err != nil {
+			t.Errorf("%s: %v", test.description, err)
+			continue
+		}
+		ignored, found := ignore.Match(test.path, test.isDir)
+		if ignored != test.ignored || found != test.found {
+			t.Errorf("%s: Match(%q, %t) = %t, %t, want %t, %t", test.description,
+				test.path, test.isDir, ignored, found, test.ignored, test.found)
+		}
+	}
+
+	// A directory without a .recipeignore file ignores nothing
+	ignore, err := LoadRecipeIgnore(t.TempDir())
+	if err != nil || ignore != nil {
+		t.Fatalf("LoadRecipeIgnore without a file = %v, %v, want nil, nil", ignore, err)
+	}
+	if ignored, found := ignore.Match("build.log", false); ignored || found {
+		t.Errorf("Match without a file = %t, %t, want false, false", ignored, found)
+	}
+}
+
+func TestMatchIgnores(t *testing.T) {
+	root := t.TempDir()
+	createTree(t, root, []string{"roles/consul/"})
+	for directory, patterns := range map[string]string{
+		root:                                   "*.log\n*.retry\n",
+		filepath.Join(root, "roles"):           "!debug.log\n",
+		filepath.Join(root, "roles", "consul"): "debug.log\nfiles/\n",
+	} {
+		err := ioutil.WriteFile(filepath.Join(directory, RecipeIgnoreFileName), []byte(patterns), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ignores := []*RecipeIgnore{}
+	for _, directory := range []string{root, filepath.Join(root, "roles"), filepath.Join(root, "roles", "consul")} {
+		ignore, err := LoadRecipeIgnore(directory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ignores = append(ignores, ignore)
+	}
+	ignores = append(ignores, nil)
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+		found   bool
+	}{
+		{path: "build.log", ignored: true, found: true},
+		{path: "roles/build.log", ignored: true, found: true},
+		{path: "roles/debug.log", found: true},
+		{path: "roles/httpproxy/debug.log", found: true},
+		{path: "roles/consul/debug.log", ignored: true, found: true},
+		{path: "roles/consul/site.retry", ignored: true, found: true},
+		{path: "roles/consul/files", isDir: true, ignored: true, found: true},
+		{path: "roles/files", isDir: true},
+		{path: "roles", isDir: true},
+		{path: "site.yml"},
+	}
+	for _, test := range tests {
+		ignored, found := MatchIgnores(ignores, filepath.Join(root, test.path), test.isDir)
+		if ignored != test.ignored || found != test.found {
+			t.Errorf("MatchIgnores(%q, %t) = %t, %t, want %t, %t",
+				test.path, test.isDir, ignored, found, test.ignored, test.found)
+		}
+	}
+
+	// A path outside of every .recipeignore directory is not matched
+	if ignored, found := MatchIgnores(ignores, filepath.Join(filepath.Dir(root), "build.log"), false); ignored || found {
+		t.Errorf("MatchIgnores outside of the root = %t, %t, want false, false", ignored, found)
+	}
+}
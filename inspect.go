@@ -0,0 +1,92 @@
+// inspect.go
+// The `inspect` command lists the host groups in a build's inventory and
+// whether each one is built as a container.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Inspect reads the inventory of the most recent build of the deployment type, or the
+// inventory from the '--inventory' argument, and writes its host groups to stdout
+func Inspect(arguments []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	deploymentType := flags.String("type", "full", "")
+	inventoryPath := flags.String("inventory", "", "")
+	ignoreHosts := flags.String("ignore-hosts", strings.Join(DefaultIgnoredHosts, ","), "")
+	err := flags.Parse(arguments)
+	if err != nil {
+		return err
+	}
+	if *deploymentType != "multiple" && *deploymentType != "full" {
+		return errors.New("a valid '--type' is required: choose between multiple or full")
+	}
+	if len(*inventoryPath) == 0 {
+		*inventoryPath = fmt.Sprintf("builds/%s/sas_viya_playbook/inventory.ini", *deploymentType)
+	}
+
+	inventory, err := LoadInventory(*inventoryPath)
+	if err != nil {
+		return fmt.Errorf("%s. Run a build or '--generate-manifests-only' first, or provide the '--inventory' argument", err.Error())
+	}
+	hostGroups, err := inventory.MemberGroups(InventoryContainerGroup)
+	if err != nil {
+		return err
+	}
+	order := &SoftwareOrder{IgnoredHosts: splitList(*ignoreHosts)}
+
+	fmt.Println("Inventory: " + inventory.Path)
+	fmt.Println()
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "HOST GROUP\tHOSTS\tCONTAINER")
+	members := make(map[string]bool)
+	for _, name := range hostGroups {
+		members[name] = true
+		status := "build"
+		if order.isIgnoredHost(name) {
+			status = "ignored"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", name, strings.Join(inventory.Groups[name].Hosts, ","), status)
+	}
+	writer.Flush()
+
+	// Groups outside of sas-all are never built
+	otherGroups := []string{}
+	for name, group := range inventory.Groups {
+		if !members[name] && len(group.Children) == 0 {
+			otherGroups = append(otherGroups, name)
+		}
+	}
+	if len(otherGroups) > 0 {
+		sort.Strings(otherGroups)
+		fmt.Printf("\nGroups that are not in %s: %s\n", InventoryContainerGroup, strings.Join(otherGroups, ", "))
+	}
+	return nil
+}
+
+// splitList splits an argument that is delimited by commas or spaces
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
+}
@@ -0,0 +1,188 @@
+// inventory.go
+// Reads the Ansible inventory.ini file of the generated playbook. Each host
+// group under the sas-all group is built as its own container.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// InventoryContainerGroup is the group whose member groups are built as containers
+const InventoryContainerGroup = "sas-all"
+
+// DefaultIgnoredHosts are the host groups that are not built unless the '--ignore-hosts' argument changes the list
+var DefaultIgnoredHosts = []string{"CommandLine", "sas-casserver-secondary", "sas-casserver-worker"}
+
+// Inventory is an Ansible INI inventory
+type Inventory struct {
+	Path   string
+	Groups map[string]*InventoryGroup
+}
+
+// InventoryGroup is a section of the inventory, which combines
+// the [name], [name:children], and [name:vars] sections
+type InventoryGroup struct {
+	Name     string
+	Hosts    []string
+	Children []string
+	Vars     map[string]string
+}
+
+// LoadInventory reads and parses an inventory file
+func LoadInventory(inventoryPath string) (*Inventory, error) {
+	content, err := ioutil.ReadFile(inventoryPath)
+	if err != nil {
+		return nil, err
+	}
+	inventory, err := ParseInventory(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the inventory %s. %s", inventoryPath, err.Error())
+	}
+	inventory.Path = inventoryPath
+	return inventory, nil
+}
+
+// ParseInventory parses the content of an INI inventory. Hosts that are listed before the first
+// section are in the "ungrouped" group, and every group is a member of the "all" group.
+func ParseInventory(content string) (*Inventory, error) {
+	inventory := &Inventory{Groups: make(map[string]*InventoryGroup)}
+	group := inventory.group("ungrouped")
+	sectionType := ""
+	for index, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		// Section headers: [name], [name:children], or [name:vars]
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: the section header %s is not closed", index+1, line)
+			}
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			sectionType = ""
+			if separator := strings.LastIndex(name, ":"); separator >= 0 {
+				sectionType = name[separator+1:]
+				name = name[:separator]
+				if sectionType != "children" && sectionType != "vars" {
+					return nil, fmt.Errorf("line %d: unknown section type :%s", index+1, sectionType)
+				}
+			}
+			if len(name) == 0 {
+				return nil, fmt.Errorf("line %d: the section header has no group name", index+1)
+			}
+			group = inventory.group(name)
+			continue
+		}
+
+		switch sectionType {
+		case "children":
+			child := strings.Fields(line)[0]
+			inventory.group(child)
+			group.Children = appendUnique(group.Children, child)
+		case "vars":
+			separator := strings.Index(line, "=")
+			if separator < 0 {
+				return nil, fmt.Errorf("line %d: the group variable %s is not in the form key=value", index+1, line)
+			}
+			group.Vars[strings.TrimSpace(line[:separator])] = strings.TrimSpace(line[separator+1:])
+		default:
+			// A host can be followed by its variables, such as "consul ansible_connection=local"
+			group.Hosts = appendUnique(group.Hosts, strings.Fields(line)[0])
+		}
+	}
+
+	all := inventory.group("all")
+	for name := range inventory.Groups {
+		if name != "all" && (name != "ungrouped" || len(inventory.Groups[name].Hosts) > 0) {
+			all.Children = appendUnique(all.Children, name)
+		}
+	}
+	sort.Strings(all.Children)
+	if len(inventory.Groups["ungrouped"].Hosts) == 0 {
+		delete(inventory.Groups, "ungrouped")
+	}
+	return inventory, nil
+}
+
+// group gets the group with the name, and adds it if it is not in the inventory yet
+func (inventory *Inventory) group(name string) *InventoryGroup {
+	group, found := inventory.Groups[name]
+	if !found {
+		group = &InventoryGroup{Name: name, Vars: make(map[string]string)}
+		inventory.Groups[name] = group
+	}
+	return group
+}
+
+// MemberGroups gets the groups under the parent group that do not have children of their own, sorted by name.
+// A child group that has its own children is replaced by its members.
+func (inventory *Inventory) MemberGroups(parent string) ([]string, error) {
+	if _, found := inventory.Groups[parent]; !found {
+		return nil, fmt.Errorf("the inventory does not have a [%s:children] section", parent)
+	}
+	members := []string{}
+	visiting := make(map[string]bool)
+	var visit func(name string) error
+	visit = func(name string) error {
+		if visiting[name] {
+			return fmt.Errorf("the inventory group %s is a member of itself", name)
+		}
+		visiting[name] = true
+		defer delete(visiting, name)
+		for _, child := range inventory.Groups[name].Children {
+			if len(inventory.Groups[child].Children) == 0 {
+				members = appendUnique(members, child)
+				continue
+			}
+			if err := visit(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(parent); err != nil {
+		return nil, err
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// isIgnoredHost checks whether the host group is in the '--ignore-hosts' list
+func (order *SoftwareOrder) isIgnoredHost(name string) bool {
+	for _, ignored := range order.IgnoredHosts {
+		if strings.EqualFold(name, ignored) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendUnique adds the value to the list if the list does not have it yet
+func appendUnique(list []string, value string) []string {
+	for _, item := range list {
+		if item == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
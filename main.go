@@ -21,9 +21,28 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 )
 
 func main() {
+	// Commands that do not build are run instead of the build
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		err := Inspect(os.Args[2:])
+		if err != nil {
+			fmt.Println("")
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "promote" {
+		err := Promote(os.Args[2:])
+		if err != nil {
+			fmt.Println("")
+			log.Fatal(err)
+		}
+		return
+	}
+
 	order, err := NewSoftwareOrder()
 	if err != nil {
 		fmt.Println("")
@@ -0,0 +1,155 @@
+// mirror.go
+// Checks that the --mirror-url repository has the software in the order
+// before the playbook and the images are built from it.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultMirrorURL is the SAS repository warehouse, which is used when there is no --mirror-url argument
+const DefaultMirrorURL = "https://ses.sas.download/ses/"
+
+// mirrorEntitlementsFile lists every repository in the mirror. mirrormgr writes it to the top of the mirror.
+const mirrorEntitlementsFile = "entitlements.json"
+
+// mirrorClient gets an HTTP client that presents the order's entitlement certificate
+// and trusts the order's SAS CA certificate, along with the system's CA certificates
+func (order *SoftwareOrder) mirrorClient() *http.Client {
+	transport := &http.Transport{TLSClientConfig: &tls.Config{}}
+	if certificate, err := tls.X509KeyPair(order.Entitlement, order.Entitlement); err == nil {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{certificate}
+	}
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil || rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+	rootCAs.AppendCertsFromPEM(order.CA)
+	transport.TLSClientConfig.RootCAs = rootCAs
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}
+}
+
+// ValidateMirror checks that each orderable in the order.oom file of the SOE has a
+// repository in the mirror, and that each of those repositories has yum metadata
+func (order *SoftwareOrder) ValidateMirror() error {
+	mirrorURL := strings.TrimSuffix(order.MirrorURL, "/") + "/"
+	client := order.mirrorClient()
+	order.WriteLog(true, "Validating the mirror repository "+mirrorURL+" ...")
+
+	response, err := client.Get(mirrorURL + mirrorEntitlementsFile)
+	if err != nil {
+		return fmt.Errorf("Unable to reach the mirror repository '--mirror-url %s'. %s", order.MirrorURL, err.Error())
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("The mirror repository '--mirror-url %s' does not have an %s file: %s. "+
+			"Check that the URL points to the top directory of a mirrormgr mirror", order.MirrorURL, mirrorEntitlementsFile, response.Status)
+	}
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	var entitlements interface{}
+	err = json.Unmarshal(content, &entitlements)
+	if err != nil {
+		return fmt.Errorf("Unable to read %s%s. %s", mirrorURL, mirrorEntitlementsFile, err.Error())
+	}
+	repoPaths := findRepoPaths(entitlements)
+
+	// Match the orderables to the repositories of the build platform
+	missingOrderables := []string{}
+	repositories := map[string]bool{}
+	for _, orderable := range order.OrderOOM.MetaRepo.Orderables {
+		found := false
+		for _, repoPath := range repoPaths {
+			if !strings.Contains(strings.ToLower(repoPath), order.Platform) {
+				continue
+			}
+			for _, segment := range strings.Split(repoPath, "/") {
+				if strings.EqualFold(segment, orderable) {
+					found = true
+					repositories[repoPath] = true
+				}
+			}
+		}
+		if !found {
+			missingOrderables = append(missingOrderables, orderable)
+		}
+	}
+	if len(missingOrderables) > 0 {
+		return fmt.Errorf("The mirror repository '--mirror-url %s' does not have a %s repository for these items in the order: %s. "+
+			"Update the mirror with mirrormgr using the same SAS_Viya_deployment_data.zip file",
+			order.MirrorURL, order.Platform, strings.Join(missingOrderables, ", "))
+	}
+
+	// Every repository needs its metadata for yum to install from it
+	sortedRepositories := []string{}
+	for repoPath := range repositories {
+		sortedRepositories = append(sortedRepositories, repoPath)
+	}
+	sort.Strings(sortedRepositories)
+	missingMetadata := []string{}
+	for _, repoPath := range sortedRepositories {
+		metadataURL := mirrorURL + strings.Trim(repoPath, "/") + "/repodata/repomd.xml"
+		response, err := client.Head(metadataURL)
+		if err != nil {
+			return fmt.Errorf("Unable to reach the mirror repository '--mirror-url %s'. %s", order.MirrorURL, err.Error())
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			missingMetadata = append(missingMetadata, metadataURL+" ("+response.Status+")")
+		}
+	}
+	if len(missingMetadata) > 0 {
+		return fmt.Errorf("The mirror repository '--mirror-url %s' is missing the repository metadata:\n%s",
+			order.MirrorURL, strings.Join(missingMetadata, "\n"))
+	}
+
+	order.WriteLog(true, fmt.Sprintf("Finished validating the mirror repository: %d orderables in %d repositories",
+		len(order.OrderOOM.MetaRepo.Orderables), len(sortedRepositories)))
+	return nil
+}
+
+// findRepoPaths gets the value of every "repoPath" key in the entitlements.json content
+func findRepoPaths(value interface{}) []string {
+	repoPaths := []string{}
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, item := range typed {
+			if path, isString := item.(string); isString && key == "repoPath" {
+				repoPaths = append(repoPaths, path)
+			} else {
+				repoPaths = append(repoPaths, findRepoPaths(item)...)
+			}
+		}
+	case []interface{}:
+		for _, item := range typed {
+			repoPaths = append(repoPaths, findRepoPaths(item)...)
+		}
+	}
+	return repoPaths
+}
@@ -0,0 +1,255 @@
+// orchestration.go
+// Downloads the sas-orchestration tool, which generates the Ansible playbook
+// from the Software Order Email, and keeps a verified copy for each SAS Viya version.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// OrchestrationToolDownload is where a version of the tool is downloaded from and the checksum of the download
+type OrchestrationToolDownload struct {
+	URL    string
+	SHA256 string // sha256sum of the tgz file
+}
+
+// OrchestrationToolDownloads is the pinned manifest of tool downloads, keyed by SasViyaVersion.
+// When SAS publishes a new tool, download it, check it, then update its SHA256 value here.
+// Until a version has a pinned checksum, the tool is taken from util/sas-orchestration.
+var OrchestrationToolDownloads = map[string]OrchestrationToolDownload{
+	"34": {
+		URL:    "https://support.sas.com/installation/viya/34/sas-orchestration-cli/lax/sas-orchestration-linux.tgz",
+		SHA256: "",
+	},
+}
+
+// OrchestrationToolCache holds a directory for each SAS Viya version of the tool.
+// It is in the builds directory so that it is kept between runs of build.sh.
+const OrchestrationToolCache = "builds/.cache/sas-orchestration/"
+
+// orchestrationToolName is the name of the binary in the downloaded tgz file
+const orchestrationToolName = "sas-orchestration"
+
+// OrchestrationToolInfo records which tool generated the playbook
+type OrchestrationToolInfo struct {
+	ViyaVersion string `json:"viya_version"`
+	Source      string `json:"source"` // URL of the download or the '--orchestration-tool' path
+	SHA256      string `json:"sha256"` // sha256sum of the binary
+}
+
+// getOrchestrationTool gets the path to the tool for SasViyaVersion. The tool from '--orchestration-tool'
+// is used if it is set, and util/sas-orchestration is used while the version has no pinned checksum.
+// Otherwise a cached tool is used if it came from the pinned download, or the tool is
+// downloaded, checked against OrchestrationToolDownloads, and added to the cache.
+func (order *SoftwareOrder) getOrchestrationTool() (string, error) {
+	if len(order.OrchestrationTool) > 0 {
+		checksum, err := fileSHA256(order.OrchestrationTool)
+		if err != nil {
+			return "", err
+		}
+		order.OrchestrationToolInfo = OrchestrationToolInfo{
+			ViyaVersion: SasViyaVersion,
+			Source:      order.OrchestrationTool,
+			SHA256:      checksum,
+		}
+		return order.OrchestrationTool, nil
+	}
+	download, found := OrchestrationToolDownloads[SasViyaVersion]
+	if !found {
+		return "", fmt.Errorf("There is no sas-orchestration tool download for SAS Viya version %s", SasViyaVersion)
+	}
+	utilToolPath := "util/" + orchestrationToolName
+	if len(download.SHA256) == 0 {
+		// A download cannot be verified without a pinned checksum, so the tool must be provided
+		checksum, err := fileSHA256(utilToolPath)
+		if err != nil {
+			return "", fmt.Errorf("There is no pinned checksum for the SAS Viya %s sas-orchestration tool, so it is not downloaded. "+
+				"Place the tool at %s or provide its path with the '--orchestration-tool' argument", SasViyaVersion, utilToolPath)
+		}
+		order.OrchestrationToolInfo = OrchestrationToolInfo{ViyaVersion: SasViyaVersion, Source: utilToolPath, SHA256: checksum}
+		return utilToolPath, nil
+	}
+	if _, err := os.Stat(utilToolPath); err == nil {
+		order.WriteLog(true, "The "+utilToolPath+" file is no longer used. "+
+			"Use the '--orchestration-tool' argument to build with a specific copy of the tool.")
+	}
+
+	cacheDirectory := OrchestrationToolCache + SasViyaVersion + "/"
+	toolPath := cacheDirectory + orchestrationToolName
+	checksumPath := toolPath + ".sha256"
+
+	// Use the cached tool when it was extracted from the pinned download and has not changed since
+	checksum, err := fileSHA256(toolPath)
+	if err == nil {
+		cachedChecksums, err := readChecksums(checksumPath)
+		if err == nil && cachedChecksums[orchestrationToolName+".tgz"] == download.SHA256 &&
+			cachedChecksums[orchestrationToolName] == checksum {
+			order.OrchestrationToolInfo = OrchestrationToolInfo{ViyaVersion: SasViyaVersion, Source: download.URL, SHA256: checksum}
+			return toolPath, nil
+		}
+		order.WriteLog(true, "The cached "+toolPath+" does not match the pinned checksum and will be downloaded again")
+	}
+	if order.Offline {
+		return "", errors.New("The sas-orchestration tool cannot be downloaded from support.sas.com in an '--offline' build. " +
+			"Provide the path to the tool with the '--orchestration-tool' argument")
+	}
+
+	err = os.MkdirAll(cacheDirectory, 0755)
+	if err != nil {
+		return "", err
+	}
+	archive, err := ioutil.TempFile(cacheDirectory, orchestrationToolName+"-*.tgz")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	// HTTP GET the file and compute its checksum while it is written
+	request, err := http.NewRequestWithContext(order.BuildContext, http.MethodGet, download.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", errors.New("Cannot fetch sas-orchestration tool. support.sas.com must be accessible, " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Cannot fetch sas-orchestration tool from %s: %s", download.URL, resp.Status)
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(archive, hash), resp.Body)
+	if err != nil {
+		return "", err
+	}
+	downloadChecksum := fmt.Sprintf("%x", hash.Sum(nil))
+	if downloadChecksum != download.SHA256 {
+		return "", fmt.Errorf("The sas-orchestration tool from %s has the sha256 checksum %s but %s was expected",
+			download.URL, downloadChecksum, download.SHA256)
+	}
+
+	_, err = archive.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	checksum, err = extractOrchestrationTool(archive, toolPath)
+	if err != nil {
+		return "", errors.New("Cannot extract sas-orchestration tool. " + err.Error())
+	}
+	// The checksums are written in the sha256sum format
+	err = ioutil.WriteFile(checksumPath, []byte(fmt.Sprintf("%s  %s.tgz\n%s  %s\n",
+		downloadChecksum, orchestrationToolName, checksum, orchestrationToolName)), 0644)
+	if err != nil {
+		return "", err
+	}
+	order.OrchestrationToolInfo = OrchestrationToolInfo{ViyaVersion: SasViyaVersion, Source: download.URL, SHA256: checksum}
+	order.WriteLog(true, fmt.Sprintf("Downloaded the SAS Viya %s sas-orchestration tool to %s", SasViyaVersion, toolPath))
+	return toolPath, nil
+}
+
+// extractOrchestrationTool writes the sas-orchestration binary from the tgz content to
+// the destination path and returns the sha256 checksum of the binary
+func extractOrchestrationTool(archive io.Reader, destination string) (string, error) {
+	gzipReader, err := gzip.NewReader(archive)
+	if err != nil {
+		return "", err
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return "", fmt.Errorf("the archive does not have a %s file", orchestrationToolName)
+		}
+		if err != nil {
+			return "", err
+		}
+		if header.Typeflag != tar.TypeReg || path.Base(header.Name) != orchestrationToolName {
+			continue
+		}
+
+		// Write to a temporary file first so a partial extract is never used
+		out, err := ioutil.TempFile(filepath.Dir(destination), orchestrationToolName+"-*")
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(out.Name())
+		hash := sha256.New()
+		_, err = io.Copy(io.MultiWriter(out, hash), tarReader)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", err
+		}
+		err = os.Chmod(out.Name(), 0755)
+		if err != nil {
+			return "", err
+		}
+		err = os.Rename(out.Name(), destination)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%x", hash.Sum(nil)), nil
+	}
+}
+
+// fileSHA256 gets the sha256 checksum of a file
+func fileSHA256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// readChecksums reads a file in the sha256sum format and gets the checksum of each file name
+func readChecksums(checksumPath string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(checksumPath)
+	if err != nil {
+		return nil, err
+	}
+	checksums := make(map[string]string)
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			checksums[strings.TrimPrefix(fields[1], "*")] = fields[0]
+		}
+	}
+	return checksums, nil
+}
@@ -41,11 +41,16 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -81,12 +86,36 @@ type SoftwareOrder struct {
 	SkipDockerValidation   bool     `yaml:"Skip Docker Validation  "`
 	GenerateManifestsOnly  bool     `yaml:"Generate Manifests Only "`
 	SkipDockerRegistryPush bool     `yaml:"Skip Docker Registry    "`
+	MultiStage             bool     `yaml:"Multi-Stage Build       "`
+	KeepBuildContext       bool     `yaml:"Keep Build Context      "`
+	GitSHA                 string   `yaml:"Git SHA                 "`
+	SBOMFormat             string   `yaml:"SBOM Format             "`
+	SignKey                string   `yaml:"Sign Key                "`
+	ScannerPath            string   `yaml:"Scanner                 "`
+	ScanSeverity           string   `yaml:"Scan Severity           "`
+	ScanCacheDir           string   `yaml:"Scan Cache Directory    "`
+	Offline                bool     `yaml:"Offline                 "`
+	OrchestrationTool      string   `yaml:"Orchestration Tool      "`
+	BaseImageTar           string   `yaml:"Base Image Tar          "`
+	IgnoredHosts           []string `yaml:"Ignored Hosts           "`
+	CASWorkers             int      `yaml:"CAS Workers             "`
+	CASSecondary           bool     `yaml:"CAS Secondary Controller"`
+	WithDependencies       bool     `yaml:"With Dependencies       "`
+	ChangedOnly            bool     `yaml:"Changed Only            "`
+	StatusAddr             string   `yaml:"Status Address          "`
+	Retries                int      `yaml:"Retries                 "`
+
+	// Limits on each container's Docker build and push, where zero is no limit, and the wait before a retry
+	BuildTimeout time.Duration `yaml:"Build Timeout           "`
+	PushTimeout  time.Duration `yaml:"Push Timeout            "`
+	RetryDelay   time.Duration `yaml:"Retry Delay             "`
 
 	// Build attributes
 	Log          *os.File              `yaml:"-"`                        // File handle for log path
-	BuildContext context.Context       `yaml:"-"`                        // Background context
+	BuildContext context.Context       `yaml:"-"`                        // Cancelled by SIGINT or SIGTERM, or when a build fails, to stop every Docker call
 	BuildOnly    []string              `yaml:"Build Only              "` // Only build these specific containers if they're in the list of entitled containers. The 'multiple' deployment type utilizes this to build only 3 images.
 	Containers   map[string]*Container `yaml:"-"`                        // Individual containers build list
+	Addons       []*Addon              `yaml:"-"`                        // Manifest of each addon in AddOns, in the order they are applied
 	Config       map[string]ConfigMap  `yaml:"-"`                        // Static values and defaults are loaded from the configmap yaml
 	ConfigPath   string                `yaml:"-"`                        // config-<deployment-type>.yml file for custom or static values
 	LogPath      string                `yaml:"-"`                        // Path to the build directory with the log file name
@@ -100,6 +129,19 @@ type SoftwareOrder struct {
 	TimestampTag string                `yaml:"Timestamp Tag           "` // Allows for datetime on each temp build bfile
 	InDocker     bool                  `yaml:"-"`                        // If we are running in a docker container
 	ManifestDir  string                `yaml:"-"`                        // The name of the manifest directory. "manifests" is the default
+	RecipeIgnore *RecipeIgnore         `yaml:"-"`                        // Paths in the project's .recipeignore file are left out of every Docker context
+	Signer       ImageSigner           `yaml:"-"`                        // Signs each image after it is pushed. Set by the --sign-key argument
+	Scanner      ImageScanner          `yaml:"-"`                        // Scans each image before it is pushed. Set by the --scanner argument
+	Progress     *ProgressView         `yaml:"-"`                        // Shows the state of each container build. Set when the builds start
+	StatusServer *StatusServer         `yaml:"-"`                        // Serves the state of the build for monitoring. Set by the --status-addr argument
+	cancelBuild  context.CancelFunc    // Cancels the BuildContext
+	certListener net.Listener          // Serves the entitlement and CA. Closed when the build finishes
+
+	// The sas-orchestration tool that generated the playbook, for the build report
+	OrchestrationToolInfo OrchestrationToolInfo `yaml:"-"`
+
+	// The report of the build before this one, which is read when the --changed-only argument is used
+	PreviousBuild *BuildReport `yaml:"-"`
 
 	// Metrics
 	StartTime      time.Time      `yaml:"-"`
@@ -118,8 +160,9 @@ type SoftwareOrder struct {
 	// │   └── SASViyaV0300_XXXXXX_Linux_x86-64.txt
 	// │   └── SASViyaV0300_XXXXXX_XXXXXXXX_Linux_x86-64.jwt
 	// └── order.oom
-	SOEZipPath string `yaml:"-"` // Used to load licenses
-	OrderOOM   struct {
+	SOEZipPath  string `yaml:"-"` // Used to load licenses
+	OrderNumber string `yaml:"-"` // From the license file name, SASViyaV0300_<order number>_Linux_x86-64.txt
+	OrderOOM    struct {
 		OomFormatVersion string `json:"oomFormatVersion"`
 		MetaRepo         struct {
 			URL        string   `json:"url"`
@@ -137,13 +180,14 @@ type SoftwareOrder struct {
 
 // Registry is ror reading ~/.docker/config.json
 // example:
-//{
-//    "auths": {
-//        "docker.mycompany.com": {
-//            "auth": "Zaoiqw0==" <-- this is a base64 string
-//        }
-//    },
-//}
+//
+//	{
+//	   "auths": {
+//	       "docker.mycompany.com": {
+//	           "auth": "Zaoiqw0==" <-- this is a base64 string
+//	       }
+//	   },
+//	}
 type Registry struct {
 	Auths map[string]struct {
 		Username string `json:"username"` // Optional
@@ -184,33 +228,19 @@ func (order *SoftwareOrder) SetupBuildDirectory() error {
 	}
 	order.Log = logHandle
 
+	// Optional: find the images of the previous build before the link is pointed at this build
+	if order.ChangedOnly {
+		order.loadPreviousBuild()
+	}
+
 	// Symbolically link the most recent time stamped build directory to a shorter name
 	// For example, 'full-2019-04-09-13-37-40' can be referred to as simply 'full'
 	// Note: This is executing inside the build container, inside a mounted volume,
-	// 		 therefore an os.Symlink() does not work correctly.
-	previousLink := "builds/" + order.DeploymentType
-	if _, err := os.Lstat(previousLink); err == nil {
-		if err := os.Remove(previousLink); err != nil {
-			return err
-		}
-	}
-	symlinkCommand := fmt.Sprintf("cd builds && ln -s %s-%s %s && cd ..",
-		order.DeploymentType, order.TimestampTag, order.DeploymentType)
-	cmd := exec.Command("sh", "-c", symlinkCommand)
-	stderr, err := cmd.StderrPipe()
+	// 		 therefore the link target is relative so it also works on the host.
+	err = replaceSymlink(order.DeploymentType+"-"+order.TimestampTag, "builds/"+order.DeploymentType)
 	if err != nil {
 		return err
 	}
-	err = cmd.Start()
-	if err != nil {
-		result, _ := ioutil.ReadAll(stderr)
-		return errors.New(string(result) + "\n" + err.Error())
-	}
-	err = cmd.Wait()
-	if err != nil {
-		result, _ := ioutil.ReadAll(stderr)
-		return errors.New(string(result) + "\n" + err.Error())
-	}
 	// A single image only uses the vars_usermods.yml. That can be used to change the
 	// running of the playbook that is used in creating the image. For "full" or
 	// "multiple" deployments, only the manifests_usermods.yml is used. It is used
@@ -229,9 +259,10 @@ func (order *SoftwareOrder) SetupBuildDirectory() error {
 
 // NewSoftwareOrder once the SOE zip file path has been provided then load all the Software Order's details
 // Note: All sub-processes of this function are essential to the build process.
-//       If any of these steps return an error then the entire process will be exited.
+// If any of these steps return an error then the entire process will be exited.
 func NewSoftwareOrder() (*SoftwareOrder, error) {
 	order := &SoftwareOrder{}
+	order.BuildContext, order.cancelBuild = context.WithCancel(context.Background())
 	order.StartTime = time.Now()
 	order.TimestampTag = string(order.StartTime.Format("2006-01-02-15-04-05"))
 	if len(order.TagOverride) > 0 {
@@ -256,6 +287,16 @@ func NewSoftwareOrder() (*SoftwareOrder, error) {
 	if err := order.SetupBuildDirectory(); err != nil {
 		return order, err
 	}
+	go order.handleSignals()
+
+	// Optional: serve the build status while the order is loaded and the images are built
+	if len(order.StatusAddr) > 0 {
+		statusServer, err := StartStatusServer(order.StatusAddr, order)
+		if err != nil {
+			return order, err
+		}
+		order.StatusServer = statusServer
+	}
 
 	// Determine if the binary is being run inside the sas-container-recipes-builder
 	order.InDocker = true
@@ -316,6 +357,15 @@ func NewSoftwareOrder() (*SoftwareOrder, error) {
 		case <-done:
 			doneCount++
 			if doneCount == workerCount {
+				// The order's details are needed to check that a mirror has all of the software.
+				// The SAS repository warehouse is not checked since it always has the software for the order.
+				if !order.SkipMirrorValidation && order.MirrorURL != DefaultMirrorURL {
+					err := order.ValidateMirror()
+					if err != nil {
+						return order, err
+					}
+				}
+
 				// After the configs have been loaded then pre-build the containers and generate the manifests
 				err := order.Prepare()
 				if err != nil {
@@ -327,10 +377,28 @@ func NewSoftwareOrder() (*SoftwareOrder, error) {
 			return order, errors.New(failure)
 		case progress := <-progress:
 			order.WriteLog(true, progress)
+		case <-order.BuildContext.Done():
+			// The workers write into the build directory, so they are stopped before it is cleaned up
+			order.waitForLoaders(workerCount-doneCount, done, progress, fail)
+			order.StatusServer.SetPhase(PhaseFailed)
+			order.Finish()
+			return order, errors.New("The build was cancelled while the order was loaded")
 		}
 	}
 }
 
+// GetTag gets the tag of the images in the <recipe_version>-<date>-<time> format
+func (order *SoftwareOrder) GetTag() string {
+	// Use the "--tag" argument if provided
+	if len(order.TagOverride) > 0 {
+		return order.TagOverride
+	}
+
+	return fmt.Sprintf("%s-%s",
+		strings.TrimSpace(RecipeVersion),
+		order.TimestampTag)
+}
+
 // BuildArgumentsSummary gets a human readable version of the command arguments
 // that were supplied to the SoftwareOrder object. This is useful for debugging.
 func (order *SoftwareOrder) BuildArgumentsSummary() string {
@@ -374,6 +442,7 @@ func (order *SoftwareOrder) Serve() {
 	if err != nil {
 		panic(err)
 	}
+	order.certListener = listener
 
 	// Serve only two endpoints to receive the entitlement and CA
 	order.WriteLog(true, fmt.Sprintf("Serving license and entitlement on sas-container-recipes-builder:%s (%s)", order.BuilderPort, order.BuilderIP))
@@ -391,10 +460,10 @@ func (order *SoftwareOrder) Serve() {
 // WriteLog is multiplexer for writing logs.
 // Write any number of object info to the build log file and/or to standard output
 func (order *SoftwareOrder) WriteLog(writeToStdout bool, contentBlocks ...interface{}) {
-	// Write each block to standard output
+	// Write each block to standard output, above the container lines while the builds are shown on a terminal
 	if writeToStdout {
 		for _, block := range contentBlocks {
-			log.Println(block)
+			order.Progress.Message(fmt.Sprint(block))
 		}
 	}
 
@@ -416,10 +485,15 @@ func (order *SoftwareOrder) WriteLog(writeToStdout bool, contentBlocks ...interf
 // out of the total number of builds.
 // This is displayed after a container finishes its build process.
 func (order *SoftwareOrder) GetIntermediateStatus(progress chan string) {
+	// The terminal view already shows the state of each container
+	if order.Progress != nil && order.Progress.Interactive {
+		return
+	}
+
 	finishedContainers := []string{}
 	remainingContainers := []string{}
 	for _, container := range order.Containers {
-		if container.Status == Pushed {
+		if container.Status == Pushed || container.Status == Retagged {
 			finishedContainers = append(finishedContainers, container.Name)
 		} else if container.Status != DoNotBuild {
 			remainingContainers = append(remainingContainers, container.Name)
@@ -439,23 +513,40 @@ func (order *SoftwareOrder) GetIntermediateStatus(progress chan string) {
 // DefineManifestDir looks at the manifests_usermods.yml to see what the manifest dir is.
 // If nothing is defined, then "manifests" is used
 func (order *SoftwareOrder) DefineManifestDir() error {
-	manifestdirGrepCommand := fmt.Sprintf("grep '^SAS_MANIFEST_DIR' %smanifests_usermods.yml | awk -F ': ' '{ print $2 }'", order.BuildPath)
-	grepResult, err := exec.Command("sh", "-c", manifestdirGrepCommand).Output()
+	manifestDir, err := order.getManifestsUsermod("SAS_MANIFEST_DIR", "manifests")
 	if err != nil {
 		return err
 	}
-	order.ManifestDir = strings.TrimSuffix(string(grepResult), "\n")
-	if len(order.ManifestDir) == 0 {
-		order.ManifestDir = "manifests"
-	}
+	order.ManifestDir = manifestDir
 	return nil
 }
 
+// getManifestsUsermod gets a top level value from the build's manifests_usermods.yml file,
+// or the default value if the file does not exist or does not set the value
+func (order *SoftwareOrder) getManifestsUsermod(key string, defaultValue string) (string, error) {
+	content, err := ioutil.ReadFile(order.BuildPath + "manifests_usermods.yml")
+	if os.IsNotExist(err) {
+		return defaultValue, nil
+	} else if err != nil {
+		return "", err
+	}
+	usermods := make(map[string]interface{})
+	err = yaml.Unmarshal(content, &usermods)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read %smanifests_usermods.yml. %s", order.BuildPath, err.Error())
+	}
+	value, found := usermods[key]
+	if !found || value == nil || len(fmt.Sprint(value)) == 0 {
+		return defaultValue, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// Standard format that arguments must comply with
+var regexNoSpecialCharacters = regexp.MustCompile("^[_A-z0-9]*([_A-z0-9\\-\\.]*)$")
+
 // LoadCommands receives flags and arguments, parse them, and load them into the order
 func (order *SoftwareOrder) LoadCommands() error {
-	// Standard format that arguments must comply with
-	regexNoSpecialCharacters := regexp.MustCompile("^[_A-z0-9]*([_A-z0-9\\-\\.]*)$")
-
 	// Required arguments
 	license := flag.String("zip", "", "")
 	dockerNamespace := flag.String("docker-namespace", "", "")
@@ -464,10 +555,18 @@ func (order *SoftwareOrder) LoadCommands() error {
 	// Optional arguments
 	virtualHost := flag.String("virtual-host", "myvirtualhost.mycompany.com", "")
 	addons := flag.String("addons", "", "")
+	addonParams := flag.String("addon-params", "", "")
 	baseImage := flag.String("base-image", "centos:7", "")
-	mirrorURL := flag.String("mirror-url", "https://ses.sas.download/ses/", "")
+	mirrorURL := flag.String("mirror-url", DefaultMirrorURL, "")
 	verbose := flag.Bool("verbose", false, "")
 	buildOnly := flag.String("build-only", "", "")
+	withDependencies := flag.Bool("with-dependencies", false, "")
+	changedOnly := flag.Bool("changed-only", false, "")
+	statusAddr := flag.String("status-addr", "", "")
+	buildTimeout := flag.Duration("build-timeout", 0, "")
+	pushTimeout := flag.Duration("push-timeout", 0, "")
+	retries := flag.Int("retries", 3, "")
+	retryDelay := flag.Duration("retry-delay", 5*time.Second, "")
 	tagOverride := flag.String("tag", RecipeVersion+"-"+order.TimestampTag, "")
 	projectName := flag.String("project-name", "sas-viya", "")
 	deploymentType := flag.String("type", "single", "")
@@ -476,6 +575,21 @@ func (order *SoftwareOrder) LoadCommands() error {
 	generateManifestsOnly := flag.Bool("generate-manifests-only", false, "")
 	builderPort := flag.String("builder-port", "1976", "")
 	skipDockerRegistryPush := flag.Bool("skip-docker-registry-push", false, "")
+	multiStage := flag.Bool("multi-stage", false, "")
+	keepBuildContext := flag.Bool("keep-build-context", false, "")
+	gitSHA := flag.String("git-sha", "", "")
+	sbomFormat := flag.String("sbom", "", "")
+	signKey := flag.String("sign-key", "", "")
+	scanner := flag.String("scanner", "", "")
+	scanSeverity := flag.String("scan-severity", "HIGH", "")
+	scanCacheDir := flag.String("scan-cache-dir", "", "")
+	offline := flag.Bool("offline", false, "")
+	orchestrationTool := flag.String("orchestration-tool", "", "")
+	baseImageTar := flag.String("base-image-tar", "", "")
+	skipMirrorValidation := flag.Bool("skip-mirror-url-validation", false, "")
+	ignoreHosts := flag.String("ignore-hosts", strings.Join(DefaultIgnoredHosts, ","), "")
+	casWorkers := flag.Int("cas-workers", 0, "")
+	casSecondary := flag.Bool("cas-secondary", false, "")
 
 	// By default detect the cpu core count and utilize all of them
 	defaultWorkerCount := runtime.NumCPU()
@@ -503,11 +617,15 @@ func (order *SoftwareOrder) LoadCommands() error {
 
 	order.Verbose = *verbose
 	order.SkipDockerValidation = *skipDockerValidation
+	order.SkipMirrorValidation = *skipMirrorValidation
 	order.GenerateManifestsOnly = *generateManifestsOnly
 	order.VirtualHost = *virtualHost
 	order.DockerRegistry = *dockerRegistry
 	order.BuilderPort = *builderPort
 	order.SkipDockerRegistryPush = *skipDockerRegistryPush
+	order.MultiStage = *multiStage
+	order.KeepBuildContext = *keepBuildContext
+	order.GitSHA = *gitSHA
 
 	// Disallow all other flags except --type with --generate-manifests-only
 	// Note: --tag is always passed from build.sh, so will have to ignore that
@@ -543,6 +661,31 @@ func (order *SoftwareOrder) LoadCommands() error {
 	}
 	order.DeploymentType = strings.ToLower(*deploymentType)
 
+	// The single container uses its own Dockerfile so it cannot be split into stages
+	if order.MultiStage && order.DeploymentType == "single" {
+		return errors.New("the '--multi-stage' argument can only be used with '--type multiple' or '--type full'")
+	}
+
+	// Optional: write an SBOM for each image in one of the supported formats
+	order.SBOMFormat = strings.ToLower(*sbomFormat)
+	if order.SBOMFormat != "" && order.SBOMFormat != SBOMFormatSPDX && order.SBOMFormat != SBOMFormatCycloneDX {
+		return errors.New("a valid '--sbom' format is required: choose between spdx or cyclonedx")
+	}
+
+	// Optional: scan each image before it is pushed and stop the push if there are severe findings
+	order.ScannerPath = *scanner
+	order.ScanSeverity = strings.ToUpper(*scanSeverity)
+	order.ScanCacheDir = *scanCacheDir
+	if severityRank(order.ScanSeverity) < 0 {
+		return fmt.Errorf("a valid '--scan-severity' is required: choose between %s", strings.Join(ScanSeverities, ", "))
+	}
+	if len(order.ScannerPath) > 0 {
+		if _, err := os.Stat(order.ScannerPath); err != nil {
+			return fmt.Errorf("the '--scanner' %s could not be found", order.ScannerPath)
+		}
+		order.Scanner = &TrivyScanner{Command: order.ScannerPath, CacheDir: order.ScanCacheDir}
+	}
+
 	// Always require a license except to re-generate manifests
 	if *license == "" && !order.GenerateManifestsOnly {
 		err := errors.New("a software order email (SOE) '--license' file is required")
@@ -583,6 +726,22 @@ func (order *SoftwareOrder) LoadCommands() error {
 		}
 	}
 
+	// Optional: Check the addon manifests and set their parameters
+	parameters, err := parseAddonParams(*addonParams)
+	if err != nil {
+		return err
+	}
+	err = order.LoadAddons(order.AddOns, parameters)
+	if err != nil {
+		return err
+	}
+
+	// Optional: paths in the project's .recipeignore file are left out of every Docker context
+	order.RecipeIgnore, err = LoadRecipeIgnore(".")
+	if err != nil {
+		return err
+	}
+
 	// Detect the platform based on the image
 	order.BaseImage = *baseImage
 	if strings.Contains(order.BaseImage, "suse") {
@@ -602,6 +761,26 @@ func (order *SoftwareOrder) LoadCommands() error {
 			"WARNING: the --mirror-url argument '%s' does not have TLS.", order.MirrorURL))
 	}
 
+	// Optional: use local copies of the orchestration tool and the base image instead of downloading them
+	order.OrchestrationTool = *orchestrationTool
+	if len(order.OrchestrationTool) > 0 {
+		if _, err := os.Stat(order.OrchestrationTool); err != nil {
+			return fmt.Errorf("the '--orchestration-tool' %s could not be found", order.OrchestrationTool)
+		}
+	}
+	order.BaseImageTar = *baseImageTar
+	if len(order.BaseImageTar) > 0 {
+		if _, err := os.Stat(order.BaseImageTar); err != nil {
+			return fmt.Errorf("the '--base-image-tar' %s could not be found", order.BaseImageTar)
+		}
+	}
+
+	// Optional: build without internet access. Only the mirror, the Docker registry, and local files are used.
+	order.Offline = *offline
+	if order.Offline && !order.GenerateManifestsOnly && order.MirrorURL == DefaultMirrorURL {
+		return errors.New("the '--offline' argument requires a '--mirror-url' that points to a local mirror of the SAS repository")
+	}
+
 	// Optional: override the standard tag format
 	order.TagOverride = *tagOverride
 	if len(order.TagOverride) > 0 && !regexNoSpecialCharacters.Match([]byte(order.TagOverride)) {
@@ -629,6 +808,70 @@ func (order *SoftwareOrder) LoadCommands() error {
 		return errors.New("a '--docker-registry-url' argument is required")
 	}
 
+	// Optional: sign each image after it is pushed. The signatures are stored in the registry next to the images
+	order.SignKey = *signKey
+	if len(order.SignKey) > 0 && !order.GenerateManifestsOnly {
+		if order.SkipDockerRegistryPush || len(order.DockerRegistry) == 0 || len(order.DockerNamespace) == 0 {
+			return errors.New("the '--sign-key' argument requires the images to be pushed. " +
+				"Provide a '--docker-registry-url' and '--docker-namespace' and do not use '--skip-docker-registry-push'")
+		}
+		signer, err := NewKeySigner(order.SignKey)
+		if err != nil {
+			return err
+		}
+		order.Signer = signer
+	}
+
+	// Optional: run CAS in MPP mode with workers and a secondary controller. They use the
+	// sas-casserver-primary image, so the sas-casserver-worker and sas-casserver-secondary
+	// host groups are not built as separate images.
+	order.CASWorkers = *casWorkers
+	order.CASSecondary = *casSecondary
+	if order.CASWorkers < 0 {
+		return errors.New("the '--cas-workers' argument must be 0 or more")
+	}
+	if (order.CASWorkers > 0 || order.CASSecondary) && order.DeploymentType == "single" {
+		return errors.New("the '--cas-workers' and '--cas-secondary' arguments can only be used with '--type multiple' or '--type full'")
+	}
+	if order.CASSecondary && order.CASWorkers == 0 {
+		return errors.New("the '--cas-secondary' argument requires CAS workers. Provide a '--cas-workers' count of 1 or more")
+	}
+
+	// Optional: only build the images whose fingerprint changed since the previous build.
+	// The other images are tagged in the registry, so the images must be pushed.
+	order.ChangedOnly = *changedOnly
+	if order.ChangedOnly && !order.GenerateManifestsOnly {
+		if order.DeploymentType == "single" {
+			return errors.New("the '--changed-only' argument can only be used with '--type multiple' or '--type full'")
+		}
+		if order.SkipDockerRegistryPush {
+			return errors.New("the '--changed-only' argument tags the unchanged images in the Docker registry, " +
+				"so it cannot be used with '--skip-docker-registry-push'")
+		}
+	}
+
+	// Optional: serve the build status and metrics, such as "--status-addr :8080"
+	order.StatusAddr = *statusAddr
+	if len(order.StatusAddr) > 0 {
+		if _, _, err := net.SplitHostPort(order.StatusAddr); err != nil {
+			return errors.New("the '--status-addr' argument must be an address such as :8080 or 127.0.0.1:8080. " + err.Error())
+		}
+	}
+
+	// Optional: fail a container whose Docker build or push takes longer than the timeout, such as "--build-timeout 2h"
+	order.BuildTimeout = *buildTimeout
+	order.PushTimeout = *pushTimeout
+	if order.BuildTimeout < 0 || order.PushTimeout < 0 {
+		return errors.New("the '--build-timeout' and '--push-timeout' arguments must be a positive duration, such as 90m or 2h")
+	}
+
+	// Pushes and the base image pull are tried again after a network failure or a registry server error
+	order.Retries = *retries
+	order.RetryDelay = *retryDelay
+	if order.Retries < 0 || order.RetryDelay < 0 {
+		return errors.New("the '--retries' argument must be 0 or more, and the '--retry-delay' argument must be a positive duration, such as 10s")
+	}
+
 	// The deployment type utilizes the order.BuildOnly list
 	// Note: the 'full' deployment type builds everything, omitting the --build-only argument
 	if order.DeploymentType == "multiple" {
@@ -655,20 +898,29 @@ func (order *SoftwareOrder) LoadCommands() error {
 			order.BuildOnly = commaDelimList
 		}
 	}
+
+	// Optional: also build the containers that the --build-only containers need at runtime
+	order.WithDependencies = *withDependencies
+
+	// Host groups in the inventory that are not built
+	order.IgnoredHosts = splitList(*ignoreHosts)
 	return nil
 }
 
 func buildWorker(id int, containers <-chan *Container, done chan<- string, progress chan string, fail chan string) {
 	for container := range containers {
-		if container.Status != Loaded {
+		// The containers that are left after the build is cancelled are not started
+		if container.Status != Loaded || container.SoftwareOrder.BuildContext.Err() != nil {
 			continue
 		}
 
 		// Build
 		container.BuildStart = time.Now()
+		container.Status = Building
+		container.SoftwareOrder.Progress.Update(container)
 		err := container.Build(progress)
 		if err != nil {
-			container.Status = Failed
+			container.SetFailed(err)
 			fail <- container.Name + ":" + container.Tag + " container build " + err.Error()
 			return
 		}
@@ -682,27 +934,67 @@ func buildWorker(id int, containers <-chan *Container, done chan<- string, progr
 		filterArgs.Add("reference", container.GetWholeImageName())
 		imageInfo, err := container.SoftwareOrder.DockerClient.ImageList(container.SoftwareOrder.BuildContext,
 			types.ImageListOptions{Filters: filterArgs})
-		if err != nil {
+		if err != nil || len(imageInfo) == 0 {
 			container.SoftwareOrder.WriteLog(true, "Unable to connect to Docker client for image build sizes")
+		} else {
+			imageSize := imageInfo[0].Size
+			container.SoftwareOrder.TotalBuildSize += imageSize
+			container.ImageSize = imageSize
+			container.SoftwareOrder.Progress.Update(container)
+		}
+
+		// Optional: list what is in the image
+		if len(container.SoftwareOrder.SBOMFormat) > 0 {
+			err = container.WriteSBOM()
+			if err != nil {
+				container.SetFailed(err)
+				fail <- container.GetWholeImageName() + " SBOM " + err.Error()
+				done <- container.Name
+				return
+			}
+			progress <- container.GetWholeImageName() + ": SBOM written to " + container.SBOMPath
+		}
+
+		// Optional: stop before the push if the image has severe vulnerabilities
+		if container.SoftwareOrder.Scanner != nil {
+			progress <- "Scanning " + container.GetWholeImageName() + " for vulnerabilities ..."
+			err = container.ScanImage()
+			if err != nil {
+				container.SetFailed(err)
+				fail <- container.GetWholeImageName() + " vulnerability scan " + err.Error()
+				done <- container.Name
+				return
+			}
+			progress <- container.GetWholeImageName() + ": passed the vulnerability scan"
 		}
-		imageSize := imageInfo[0].Size
-		container.SoftwareOrder.TotalBuildSize += imageSize
-		container.ImageSize = imageSize
 
 		if !container.SoftwareOrder.SkipDockerRegistryPush {
 			// Push
 			container.PushStart = time.Now()
 			err = container.Push(progress)
 			if err != nil {
-				container.Status = Failed
+				container.SetFailed(err)
 				fail <- container.GetWholeImageName() + " container push " + err.Error()
 				done <- container.Name
 				return
 			}
 			container.PushEnd = time.Now()
 
+			// Optional: sign the pushed image
+			if container.SoftwareOrder.Signer != nil {
+				container.SignatureDigest, err = container.SoftwareOrder.Signer.Sign(container, container.Digest)
+				if err != nil {
+					container.SetFailed(err)
+					fail <- container.GetWholeImageName() + " container signing " + err.Error()
+					done <- container.Name
+					return
+				}
+				progress <- container.GetWholeImageName() + ": signed " + container.Digest
+			}
+
 			// Signal the end of the build and push processes
 			container.Status = Pushed
+			container.SoftwareOrder.Progress.Update(container)
 			progress <- container.GetWholeImageName() + ": finished pushing image to Docker registry"
 			container.SoftwareOrder.GetIntermediateStatus(progress)
 		} else {
@@ -751,7 +1043,11 @@ func getProgrammingOnlySingleContainer(order *SoftwareOrder) error {
 	if err != nil {
 		return err
 	}
-	err = container.AddFileToContext(resourceDirectory+"/sas-orchestration", "sas-orchestration", []byte{})
+	orchestrationTool, err := order.getOrchestrationTool()
+	if err != nil {
+		return err
+	}
+	err = container.AddFileToContext(orchestrationTool, "sas-orchestration", []byte{})
 	if err != nil {
 		return err
 	}
@@ -769,7 +1065,7 @@ func getProgrammingOnlySingleContainer(order *SoftwareOrder) error {
 
 	// Add files from the addons directory to the build context
 	for _, addon := range order.AddOns {
-		err := container.AddDirectoryToContext(addon, "", "")
+		err := container.AddDirectoryToContext(addon, "")
 		if err != nil {
 			return errors.New("Unable to place addon files into Docker context. " + err.Error())
 		}
@@ -780,14 +1076,21 @@ func getProgrammingOnlySingleContainer(order *SoftwareOrder) error {
 	if err != nil {
 		return err
 	}
-	dockerfile, err := appendAddonLines(container.GetName(), string(dockerfileStub), container.SoftwareOrder.DeploymentType, container.SoftwareOrder.AddOns)
+	dockerfile, warnings, err := appendAddonLines(container.addonImageName(), string(dockerfileStub), container.SoftwareOrder.Addons)
 	if err != nil {
 		return err
 	}
+	for _, warning := range warnings {
+		order.WriteLog(true, warning)
+	}
 	err = container.AddFileToContext("", "Dockerfile", []byte(dockerfile))
 	if err != nil {
 		return err
 	}
+	err = container.WriteDockerContext()
+	if err != nil {
+		return err
+	}
 
 	// Make the software order only build the image that was created in this function
 	for _, item := range order.Containers {
@@ -807,14 +1110,27 @@ func (order *SoftwareOrder) Build() error {
 			return err
 		}
 	}
+
+	// Optional: tag the unchanged images instead of building them
+	if order.ChangedOnly {
+		order.RetagUnchanged()
+	}
 	numberOfBuilds := 0
+	numberOfRetagged := 0
 	for _, container := range order.Containers {
 		if container.Status == Loaded {
 			numberOfBuilds++
+		} else if container.Status == Retagged {
+			numberOfRetagged++
 		}
 	}
 	fmt.Println("")
-	if numberOfBuilds == 0 {
+	if numberOfBuilds == 0 && numberOfRetagged > 0 {
+		order.WriteLog(true, "Every image is unchanged since the previous build, so there is nothing to build.")
+		order.StatusServer.SetPhase(PhaseFinished)
+		order.Finish()
+		return nil
+	} else if numberOfBuilds == 0 {
 		return errors.New("The number of builds are set to zero. " +
 			"An error in pre-build tasks may have occurred or the " +
 			"Software Order entitlement does not match the deployment type.")
@@ -827,13 +1143,28 @@ func (order *SoftwareOrder) Build() error {
 	}
 	order.WriteLog(true, "[TIP] System resource utilization can be seen by using the `docker stats` command.")
 
+	// On a terminal each container has a line that is redrawn. The whole build output
+	// of --verbose is written as plain lines with the container name in front of each.
+	order.Progress = NewProgressView(order.Containers)
+	if order.Verbose {
+		order.Progress.Interactive = false
+	}
+	order.StatusServer.Watch(order.Progress)
+	refresh := time.NewTicker(ProgressRefresh)
+	defer refresh.Stop()
+
 	// Concurrently start each build process
 	jobs := make(chan *Container, 100)
 	fail := make(chan string)
 	done := make(chan string)
 	progress := make(chan string)
+	workers := &sync.WaitGroup{}
 	for w := 1; w <= order.WorkerCount; w++ {
-		go buildWorker(w, jobs, done, progress, fail)
+		workers.Add(1)
+		go func(id int) {
+			defer workers.Done()
+			buildWorker(id, jobs, done, progress, fail)
+		}(w)
 	}
 	for _, container := range order.Containers {
 		jobs <- container
@@ -845,17 +1176,86 @@ func (order *SoftwareOrder) Build() error {
 		case <-done:
 			doneCount++
 			if doneCount == numberOfBuilds {
+				order.Progress.Draw()
+				order.StatusServer.SetPhase(PhaseFinished)
 				order.Finish()
 				return nil
 			}
 		case failure := <-fail:
-			return errors.New(failure)
+			return order.stopBuild(failure, workers, done, progress, fail)
 		case progress := <-progress:
-			order.WriteLog(true, progress)
+			order.WriteLog(false, progress)
+			order.Progress.Message(progress)
+		case <-refresh.C:
+			order.Progress.Draw()
+		case <-order.BuildContext.Done():
+			return order.stopBuild("The build was cancelled", workers, done, progress, fail)
 		}
 	}
 }
 
+// stopBuild cancels the builds and pushes that are still running, waits for the workers to stop,
+// then writes the build report and cleans up. The failure is returned as the build's error.
+func (order *SoftwareOrder) stopBuild(failure string, workers *sync.WaitGroup,
+	done chan string, progress chan string, fail chan string) error {
+	order.cancelBuild()
+	order.waitForWorkers(workers, done, progress, fail)
+
+	order.Progress.Draw()
+	order.StatusServer.SetPhase(PhaseFailed)
+	order.Finish()
+	return errors.New(failure)
+}
+
+// waitForWorkers waits for the workers to stop. Their messages are written to the
+// build log only, and are read so that a worker is never stuck sending one.
+func (order *SoftwareOrder) waitForWorkers(workers *sync.WaitGroup, done chan string, progress chan string, fail chan string) {
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-done:
+		case failure := <-fail:
+			order.WriteLog(false, failure)
+		case message := <-progress:
+			order.WriteLog(false, message)
+		}
+	}
+}
+
+// waitForLoaders waits for the workers that load the order to stop. Each worker
+// sends one message on done or fail when it stops.
+func (order *SoftwareOrder) waitForLoaders(running int, done chan int, progress chan string, fail chan string) {
+	for running > 0 {
+		select {
+		case <-done:
+			running--
+		case failure := <-fail:
+			order.WriteLog(false, failure)
+			running--
+		case message := <-progress:
+			order.WriteLog(false, message)
+		}
+	}
+}
+
+// handleSignals cancels the build on SIGINT or SIGTERM so that the Docker builds and pushes stop
+// and the build is cleaned up. A second signal exits right away.
+func (order *SoftwareOrder) handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	received := <-signals
+	order.WriteLog(true, fmt.Sprintf("Received %s, stopping the builds ... (repeat to exit right away)", received))
+	order.cancelBuild()
+	<-signals
+	os.Exit(130)
+}
+
 // Get the names of each individual host to be created
 //
 // Read the sas_viya_playbook directory for the "group_vars" where each
@@ -863,38 +1263,17 @@ func (order *SoftwareOrder) Build() error {
 func getContainers(order *SoftwareOrder) (map[string]*Container, error) {
 	containers := make(map[string]*Container)
 
-	// These values are not added to the final hostGroup list result
-	var ignoredContainers = [...]string{
-		"all", "sas-all", "CommandLine",
-		"sas-casserver-secondary", "sas-casserver-worker",
-	}
-
 	// The names inside the playbook's inventory file are mapped to hosts
-	inventoryBytes, err := ioutil.ReadFile(order.BuildPath + "sas_viya_playbook/" + "inventory.ini")
+	inventory, err := LoadInventory(order.BuildPath + "sas_viya_playbook/" + "inventory.ini")
 	if err != nil {
 		return containers, err
 	}
-	inventory := string(inventoryBytes)
-	startLine := 0
-	startOfSection := "[sas-all:children]"
-	lines := strings.Split(inventory, "\n")
-	for index, line := range lines {
-		if line == startOfSection {
-			startLine = index
-		}
-	}
-	if startLine == 0 {
-		return containers, errors.New("Cannot find inventory.ini section with all container names")
+	hostGroups, err := inventory.MemberGroups(InventoryContainerGroup)
+	if err != nil {
+		return containers, errors.New("Cannot find inventory.ini section with all container names. " + err.Error())
 	}
-	for i := startLine + 1; i < len(lines); i++ {
-		skip := false
-		name := lines[i]
-		for _, ignored := range ignoredContainers {
-			if name == ignored {
-				skip = true
-			}
-		}
-		if skip || len(strings.TrimSpace(name)) == 0 {
+	for _, name := range hostGroups {
+		if order.isIgnoredHost(name) {
 			continue
 		}
 
@@ -952,6 +1331,10 @@ func (order *SoftwareOrder) LoadLicense(progress chan string, fail chan string,
 
 		if strings.Contains(zippedFile.Name, "Linux_x86-64.txt") {
 			order.License = fileBytes
+			nameParts := strings.Split(filepath.Base(zippedFile.Name), "_")
+			if len(nameParts) > 2 {
+				order.OrderNumber = nameParts[1]
+			}
 		} else if strings.Contains(zippedFile.Name, "Linux_x86-64.jwt") {
 			order.MeteredLicense = fileBytes
 		} else if strings.Contains(zippedFile.Name, "SAS_CA_Certificate.pem") {
@@ -992,12 +1375,51 @@ func (order *SoftwareOrder) LoadDocker(progress chan string, fail chan string, d
 	order.DockerClient = dockerConnection
 	progress <- "Finished connecting to Docker daemon"
 
+	// Load the base image from a file instead of pulling it
+	if len(order.BaseImageTar) > 0 {
+		progress <- "Loading base container image from '" + order.BaseImageTar + "' ..."
+		tarFile, err := os.Open(order.BaseImageTar)
+		if err != nil {
+			fail <- err.Error()
+			return
+		}
+		defer tarFile.Close()
+		loadResponse, err := order.DockerClient.ImageLoad(order.BuildContext, tarFile, true)
+		if err != nil {
+			fail <- "Unable to load the '--base-image-tar' " + order.BaseImageTar + ". " + err.Error()
+			return
+		}
+		ioutil.ReadAll(loadResponse.Body)
+		loadResponse.Body.Close()
+	}
+
+	// Offline builds only use an image that is already on the build machine
+	if len(order.BaseImageTar) > 0 || order.Offline {
+		_, _, err = order.DockerClient.ImageInspectWithRaw(order.BuildContext, order.BaseImage)
+		if err != nil {
+			fail <- fmt.Sprintf("The base image '%s' is not on the build machine. "+
+				"Provide a '--base-image-tar' file that has the image, or run `docker load` before building. %s", order.BaseImage, err.Error())
+			return
+		}
+		progress <- "Using base container image '" + order.BaseImage + "' from the build machine"
+		done <- 1
+		return
+	}
+
 	// Pull the base image depending on what the argument was
 	progress <- "Pulling base container image '" + order.BaseImage + "'" + " ..."
-	order.BuildContext = context.Background()
-	_, err = order.DockerClient.ImagePull(order.BuildContext, order.BaseImage, types.ImagePullOptions{})
+	logAttempt := func(message string) {
+		progress <- message
+	}
+	err = order.RetryPolicy().Do(order.BuildContext, "pull of "+order.BaseImage, logAttempt, func() error {
+		pullResponse, err := order.DockerClient.ImagePull(order.BuildContext, order.BaseImage, types.ImagePullOptions{})
+		if err != nil {
+			return err
+		}
+		return readDockerPullStream(pullResponse)
+	})
 	if err != nil {
-		fail <- err.Error()
+		fail <- "Unable to pull the base image '" + order.BaseImage + "'. " + err.Error()
 		return
 	}
 
@@ -1130,7 +1552,7 @@ func (order *SoftwareOrder) LoadPlaybook(progress chan string, fail chan string,
 
 	// Check to see if the tool exists
 	progress <- "Fetching orchestration tool ..."
-	err := getOrchestrationTool()
+	orchestrationTool, err := order.getOrchestrationTool()
 	if err != nil {
 		fail <- "Failed to install sas-orchestration tool. " + err.Error()
 		return
@@ -1139,20 +1561,20 @@ func (order *SoftwareOrder) LoadPlaybook(progress chan string, fail chan string,
 
 	// Run the orchestration tool to make the playbook
 	progress <- "Generating playbook for order ..."
-	commandBuilder := []string{"util/sas-orchestration build"}
-	commandBuilder = append(commandBuilder, "--platform redhat")
-	commandBuilder = append(commandBuilder, "--input "+order.SOEZipPath)
-	commandBuilder = append(commandBuilder, "--output "+order.BuildPath+"sas_viya_playbook.tgz")
-	commandBuilder = append(commandBuilder, "--repository-warehouse "+order.MirrorURL)
+	commandBuilder := []string{"build"}
+	commandBuilder = append(commandBuilder, "--platform", "redhat")
+	commandBuilder = append(commandBuilder, "--input", order.SOEZipPath)
+	commandBuilder = append(commandBuilder, "--output", order.BuildPath+"sas_viya_playbook.tgz")
+	commandBuilder = append(commandBuilder, "--repository-warehouse", order.MirrorURL)
 	if order.DeploymentType == "multiple" {
-		commandBuilder = append(commandBuilder, "--deployment-type programming")
+		commandBuilder = append(commandBuilder, "--deployment-type", "programming")
 	}
-	playbookCommand := strings.Join(commandBuilder, " ")
+	playbookCommand := orchestrationTool + " " + strings.Join(commandBuilder, " ")
 	order.WriteLog(false, playbookCommand)
 
 	// The following is to fully provide the output of anything that goes wrong
 	// when generating the playbook.
-	cmd := exec.Command("sh", "-c", playbookCommand)
+	cmd := exec.CommandContext(order.BuildContext, orchestrationTool, commandBuilder...)
 	cmdReader, err := cmd.StdoutPipe()
 	if err != nil {
 		fail <- "[ERROR] Could not create StdoutPipe for Cmd. " + err.Error() + "\n" + playbookCommand
@@ -1199,18 +1621,15 @@ func (order *SoftwareOrder) LoadPlaybook(progress chan string, fail chan string,
 	// This is required for the Generate Manifests function in multiple and
 	// full deployment types, not in the single container.
 	if order.DeploymentType != "single" {
-		testAnsibleInstall := "ansible --version"
-		_, err = exec.Command("sh", "-c", testAnsibleInstall).Output()
+		_, err = exec.Command("ansible", "--version").Output()
 		if err != nil {
 			fail <- "[ERROR]: The package `ansible` must be installed inside the build container in order to generate Kubernetes manifests."
 			return
 		}
 	}
 
-	// TODO replace with "golang.org/x/build/internal/untar"
 	progress <- "Extracting generated playbook content ..."
-	untarPlaybookCommand := fmt.Sprintf("tar --extract --file %ssas_viya_playbook.tgz -C %s", order.BuildPath, order.BuildPath)
-	_, err = exec.Command("sh", "-c", untarPlaybookCommand).Output()
+	err = extractTarGz(order.BuildPath+"sas_viya_playbook.tgz", order.BuildPath)
 	if err != nil {
 		fail <- "Unable to untar playbook. " + err.Error()
 		return
@@ -1226,13 +1645,9 @@ func (order *SoftwareOrder) LoadPlaybook(progress chan string, fail chan string,
 	// Work-around for the 19w34 update to sas-orchestration which changes
 	// dashes in some container names to underscores.
 	// Convert the inventory ini so that any underscores are converted to back into dashes.
-	underbarConversionCommand := fmt.Sprintf("for sashost in $(grep '^sas_.*$' %[1]v/inventory.ini); do echo $sashost; dashstring=$(echo $sashost | sed 's/_/-/g'); echo $dashstring; sed -i \"s/${sashost}/${dashstring}/g\" %[1]v/inventory.ini; cp %[1]v/group_vars/${sashost} %[1]v/group_vars/${dashstring}; done; cp %[1]v/group_vars/sas_all %[1]v/group_vars/sas-all; sed -i 's/sas_all/sas-all/g' %[1]v/inventory.ini;",
-		order.PlaybookPath)
-	order.WriteLog(false, false, underbarConversionCommand)
-	result, err := exec.Command("sh", "-c", underbarConversionCommand).Output()
+	err = convertInventoryUnderscores(order.PlaybookPath)
 	if err != nil {
-		fail <- fmt.Sprintf("Unable to change inventory group_vars files. \n\n%s\n\n Returned error: %s\n%s",
-			underbarConversionCommand, result, err.Error())
+		fail <- "Unable to change inventory group_vars files. " + err.Error()
 		return
 	}
 
@@ -1247,36 +1662,64 @@ func (order *SoftwareOrder) LoadPlaybook(progress chan string, fail chan string,
 
 	// Handle --build-only options without modifying the order's container attributes
 	if len(order.BuildOnly) > 0 {
-
-		// If the image is not in the --build-only list then set its status to Do Not Build
-		imageNameMatches := []string{} // Image names that are provided in the --build-only argument and exist in the software order
-		imageNameOptions := []string{} // Image names that are in the software order
-		for index, container := range order.Containers {
-			matchFound := false
-			imageNameOptions = append(imageNameOptions, container.Name)
-			for _, targetName := range order.BuildOnly {
-				if container.Name == targetName {
-					// Container's name is in the --build-only list
-					matchFound = true
-					imageNameMatches = append(imageNameMatches, container.Name)
-				}
-			}
-			if !matchFound {
-				order.Containers[index].Status = DoNotBuild
-			}
+		selected, err := order.SelectContainers()
+		if err != nil {
+			fail <- err.Error()
+			return
 		}
 
-		// Make sure there is at least 1 image that's going to be built
-		if len(order.BuildOnly) != len(imageNameMatches) {
-			order.WriteLog(true, fmt.Sprintf("\nSelected Image Builds: %s\nAvailable Image Builds: %s\n", order.BuildOnly, imageNameOptions))
-			fail <- "One or more of the chosen --build-only containers do not exist. "
-			return
+		// If the image is not selected then set its status to Do Not Build
+		for _, container := range order.Containers {
+			container.Status = DoNotBuild
+		}
+		for _, name := range selected {
+			order.Containers[name].Status = Unknown
 		}
+		progress <- "Selected Image Builds: " + strings.Join(selected, ", ")
 	}
 
 	done <- 1
 }
 
+// convertInventoryUnderscores changes the sas_ host names in the playbook's inventory.ini to use dashes,
+// such as sas_casserver_primary to sas-casserver-primary, and copies the group_vars file of each host
+// to its new name. The group_vars files with the old names are kept.
+func convertInventoryUnderscores(playbookPath string) error {
+	inventoryPath := filepath.Join(playbookPath, "inventory.ini")
+	content, err := ioutil.ReadFile(inventoryPath)
+	if err != nil {
+		return err
+	}
+
+	hosts := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "sas_") {
+			hosts = append(hosts, strings.Fields(line)...)
+		}
+	}
+	hosts = append(hosts, "sas_all")
+
+	// Replace the longest names first so a name is never changed by a shorter name that it starts with
+	sort.SliceStable(hosts, func(i, j int) bool {
+		return len(hosts[i]) > len(hosts[j])
+	})
+	replacements := []string{}
+	for _, host := range hosts {
+		dashedHost := strings.Replace(host, "_", "-", -1)
+		replacements = append(replacements, host, dashedHost)
+
+		groupVars := filepath.Join(playbookPath, "group_vars", host)
+		if _, err := os.Stat(groupVars); err == nil {
+			err = copyFile(groupVars, filepath.Join(playbookPath, "group_vars", dashedHost))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	content = []byte(strings.NewReplacer(replacements...).Replace(string(content)))
+	return ioutil.WriteFile(inventoryPath, content, 0644)
+}
+
 // Prepare concurrently loads all container's configurations if the container is staged to be built
 func (order *SoftwareOrder) Prepare() error {
 	// Ignore this in the single container
@@ -1289,14 +1732,17 @@ func (order *SoftwareOrder) Prepare() error {
 	done := make(chan string)
 	progress := make(chan string)
 	workerCount := 0
+	workers := &sync.WaitGroup{}
 	for _, container := range order.Containers {
 		if container.Status != DoNotBuild {
 			workerCount++
+			workers.Add(1)
 			go func(container *Container, progress chan string, fail chan string) {
+				defer workers.Done()
 				container.Status = Loading
 				err := container.Prebuild(progress)
 				if err != nil {
-					container.Status = Failed
+					container.SetFailed(err)
 					fail <- container.Name + " prebuild " + err.Error()
 				}
 				done <- container.Name
@@ -1324,6 +1770,12 @@ func (order *SoftwareOrder) Prepare() error {
 			order.WriteLog(true, failure)
 		case progress := <-progress:
 			order.WriteLog(true, progress)
+		case <-order.BuildContext.Done():
+			// The Docker contexts and clients are released by Finish, so the workers must stop first
+			order.waitForWorkers(workers, done, progress, fail)
+			order.StatusServer.SetPhase(PhaseFailed)
+			order.Finish()
+			return errors.New("The build was cancelled while the Docker contexts were created")
 		}
 	}
 }
@@ -1378,6 +1830,7 @@ func (order *SoftwareOrder) GenerateManifests() error {
 	} else {
 		// Write a vars file to disk so it can be used by the playbook
 		containerVarSections := []string{}
+		addonConfigMaps := make(map[string]map[string]string)
 		for _, container := range order.Containers {
 			if container.Status == DoNotBuild {
 				continue
@@ -1390,10 +1843,14 @@ func (order *SoftwareOrder) GenerateManifests() error {
 			}
 
 			// Environment section
+			environmentItems := container.Config.Environment
+			if container.Name == "sas-casserver-primary" {
+				environmentItems = order.casEnvironment(environmentItems)
+			}
 			environment := "    environment:"
-			if len(container.Config.Environment) > 0 {
+			if len(environmentItems) > 0 {
 				environment += "\n"
-				for _, item := range container.Config.Environment {
+				for _, item := range environmentItems {
 					environment += "    - " + item + "\n"
 				}
 			} else {
@@ -1444,12 +1901,19 @@ func (order *SoftwareOrder) GenerateManifests() error {
 				}
 			}
 
+			// Addons section: Kubernetes volumes, volume mounts, and init containers
+			addonVars, err := order.addonManifestVars(container.addonImageName(), addonConfigMaps)
+			if err != nil {
+				return err
+			}
+
 			// Final formatting for container's section
 			containerSection := "  " + container.Name + ":\n"
 			containerSection += ports
 			containerSection += environment
 			containerSection += secrets
 			containerSection += volumes
+			containerSection += addonVars
 			containerSection += resources
 			containerVarSections = append(containerVarSections, containerSection)
 		}
@@ -1461,8 +1925,10 @@ PROJECT_NAME: %s
 docker_tag: %s
 SECURE_CONSUL: false
 DISABLE_CONSUL_HTTP_PORT: false
+CAS_WORKERS: %d
+CAS_SECONDARY: %t
 `,
-			order.ProjectName, order.TagOverride)
+			order.ProjectName, order.TagOverride, order.CASWorkers, order.CASSecondary)
 
 		// Write a temp file
 		varsDeploymentFilePath := order.BuildPath + "vars_deployment.yml"
@@ -1486,6 +1952,27 @@ settings:
 		for _, section := range containerVarSections {
 			serviceSettings += section + "\n"
 		}
+
+		// The ConfigMaps created from addon files are shared by every container the addon modifies
+		if len(addonConfigMaps) > 0 {
+			configMapNames := []string{}
+			for name := range addonConfigMaps {
+				configMapNames = append(configMapNames, name)
+			}
+			sort.Strings(configMapNames)
+			configMapList := []map[string]interface{}{}
+			for _, name := range configMapNames {
+				configMapList = append(configMapList, map[string]interface{}{
+					"name": name,
+					"data": addonConfigMaps[name],
+				})
+			}
+			configMapVars, err := yaml.Marshal(map[string]interface{}{"addon_configmaps": configMapList})
+			if err != nil {
+				return err
+			}
+			serviceSettings += string(configMapVars)
+		}
 		registries := fmt.Sprintf("registries: \n  docker-registry:\n    url: %s \n    namespace: %s",
 			order.DockerRegistry, order.DockerNamespace)
 		serviceSettings += registries
@@ -1498,18 +1985,15 @@ settings:
 		}
 
 		// Copy over the playbook files that contain configurations
-		copyVarsCommand := fmt.Sprintf("cp %ssas_viya_playbook/vars.yml %svars.yml", order.BuildPath, order.BuildPath)
-		_, err = exec.Command("sh", "-c", copyVarsCommand).Output()
+		err = copyFile(order.BuildPath+"sas_viya_playbook/vars.yml", order.BuildPath+"vars.yml")
 		if err != nil {
 			return err
 		}
-		copyAllCommand := fmt.Sprintf("cp %ssas_viya_playbook/group_vars/all %sall.yml", order.BuildPath, order.BuildPath)
-		_, err = exec.Command("sh", "-c", copyAllCommand).Output()
+		err = copyFile(order.BuildPath+"sas_viya_playbook/group_vars/all", order.BuildPath+"all.yml")
 		if err != nil {
 			return err
 		}
-		copySoeDefaultsCommand := fmt.Sprintf("cp %ssas_viya_playbook/internal/soe_defaults.yml %ssoe_defaults.yml", order.BuildPath, order.BuildPath)
-		_, err = exec.Command("sh", "-c", copySoeDefaultsCommand).Output()
+		err = copyFile(order.BuildPath+"sas_viya_playbook/internal/soe_defaults.yml", order.BuildPath+"soe_defaults.yml")
 		if err != nil {
 			return err
 		}
@@ -1552,8 +2036,9 @@ settings:
 	}
 
 	// Run the playbook locally to generate the Kubernetes manifests
-	manifestsCommand := fmt.Sprintf("ansible-playbook --connection=local --inventory 127.0.0.1, %sgenerate_manifests.yml -vv", order.BuildPath)
-	result, err := exec.Command("sh", "-c", manifestsCommand).Output()
+	manifestsArguments := []string{"--connection=local", "--inventory", "127.0.0.1,", order.BuildPath + "generate_manifests.yml", "-vv"}
+	manifestsCommand := "ansible-playbook " + strings.Join(manifestsArguments, " ")
+	result, err := exec.CommandContext(order.BuildContext, "ansible-playbook", manifestsArguments...).Output()
 	if err != nil {
 		result := string(result) + "\n" + manifestsCommand + "\n"
 		result += string(result) + "\n" + err.Error() + "\n"
@@ -1567,6 +2052,37 @@ settings:
 	return nil
 }
 
+// casEnvironment gets the CAS controller's environment for the '--cas-workers' and '--cas-secondary'
+// arguments. With workers, CAS runs in MPP mode and its initial worker count is set.
+func (order *SoftwareOrder) casEnvironment(environment []string) []string {
+	if order.CASWorkers == 0 {
+		return environment
+	}
+	settings := map[string]string{
+		"CASCFG_MODE":           "mpp",
+		"CASCFG_INITIALWORKERS": strconv.Itoa(order.CASWorkers),
+	}
+	if order.CASSecondary {
+		settings["CASCFG_INITIALBACKUPS"] = "1"
+	}
+
+	result := []string{}
+	for _, item := range environment {
+		name := strings.SplitN(item, "=", 2)[0]
+		if value, found := settings[name]; found {
+			item = name + "=" + value
+			delete(settings, name)
+		}
+		result = append(result, item)
+	}
+	for _, name := range []string{"CASCFG_MODE", "CASCFG_INITIALWORKERS", "CASCFG_INITIALBACKUPS"} {
+		if value, found := settings[name]; found {
+			result = append(result, name+"="+value)
+		}
+	}
+	return result
+}
+
 // LoadUsermods retrieves the user provided vars_usermods.yml file
 // from the project directory then copies it into the build
 // directory, or if the file was not provided then the
@@ -1599,53 +2115,27 @@ func (order *SoftwareOrder) LoadUsermods(usermodsFileName string) error {
 	return nil
 }
 
-// Download the orchestration tool locally if it is not in the util directory
-func getOrchestrationTool() error {
-	_, err := os.Stat("util/sas-orchestration")
-	if !os.IsNotExist(err) {
-		return nil
-	}
-
-	// HTTP GET the file
-	fileURL := fmt.Sprintf("https://support.sas.com/installation/viya/%s/sas-orchestration-cli/lax/sas-orchestration-linux.tgz", SasViyaVersion)
-	resp, err := http.Get(fileURL)
-	if err != nil {
-		return errors.New("Cannot fetch sas-orchestration tool. support.sas.com must be accessible, " + err.Error())
-	}
-	defer resp.Body.Close()
-
-	// Write the HTTP GET result to a file
-	out, err := os.Create("util/sas-orchestration.tgz")
-	if err != nil {
-		return err
+// Finish writes the build report, stops serving the entitlement, CA, and build status, and releases each
+// container's Docker context, client, and log. It is called when the build ends, fails, or is cancelled.
+func (order *SoftwareOrder) Finish() {
+	order.EndTime = time.Now()
+	if order.certListener != nil {
+		order.certListener.Close()
 	}
-	defer out.Close()
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		return err
+	if err := order.WriteBuildReport(); err != nil {
+		order.WriteLog(true, "Unable to write the build report", err)
 	}
-
-	// Untar the result and move it into the util directory
-	untarCommand := "tar -xf util/sas-orchestration.tgz -C util/"
-	_, err = exec.Command("sh", "-c", untarCommand).Output()
-	if err != nil {
-		return errors.New("Cannot untar sas-orchestration tool. " + err.Error())
+	for _, container := range order.Containers {
+		if container.Status != DoNotBuild {
+			err := container.Finish()
+			if err != nil {
+				order.WriteLog(false, "Unable to clean up after "+container.Name, err)
+			}
+		}
 	}
 
-	// Clean up
-	os.Remove("util/sas-orchestration.tgz")
-	return nil
-}
-
-// Finish removes all temporary build files: sas_viya_playbook and all Docker contexts (tar files) in the /tmp directory
-func (order *SoftwareOrder) Finish() {
-	order.EndTime = time.Now()
-	// TODO
-	//for _, container := range order.Containers {
-	//	if container.Status != DoNotBuild {
-	//		container.Finish()
-	//	}
-	//}
+	// The status is served for a short time after the build ends, so it can be scraped one last time
+	order.StatusServer.Close()
 }
 
 // Helper function to convert an image size to a human readable value
@@ -1653,6 +2143,11 @@ func bytesToGB(bytes int64) string {
 	return fmt.Sprintf("%.2f GB", float64(bytes)/float64(1000000000))
 }
 
+// Helper function to convert a file size to a human readable value
+func bytesToMB(bytes int64) string {
+	return fmt.Sprintf("%.2f MB", float64(bytes)/float64(1000000))
+}
+
 // ShowSummary displays metrics and next steps for deployment
 func (order *SoftwareOrder) ShowSummary() error {
 	if order.DeploymentType == "single" {
@@ -1693,6 +2188,12 @@ Note: If you used the auth-sssd addon or customised the user in the auth-demo ad
 					container.PushEnd.Sub(container.PushStart).Round(time.Second))
 				fmt.Println(output)
 				order.WriteLog(false, output)
+			} else if container.Status == Retagged {
+				output := fmt.Sprintf("%s\n\tSize: %s\tUnchanged since the previous build",
+					container.GetWholeImageName(),
+					bytesToGB(container.ImageSize))
+				fmt.Println(output)
+				order.WriteLog(false, output)
 			}
 		}
 	}
@@ -1707,15 +2208,10 @@ Note: If you used the auth-sssd addon or customised the user in the auth-demo ad
 	//       have a way to discover this information so it is reflects in the data
 	//       given to the user.
 	symlinkBuildPath := fmt.Sprintf("builds/%s/%s", order.DeploymentType, order.ManifestDir)
-	namespaceGrepCommand := fmt.Sprintf("grep '^SAS_K8S_NAMESPACE' %smanifests_usermods.yml | awk -F ': ' '{ print $2 }'", order.BuildPath)
-	grepResult, err := exec.Command("sh", "-c", namespaceGrepCommand).Output()
+	kubeNamespace, err := order.getManifestsUsermod("SAS_K8S_NAMESPACE", "sas-viya")
 	if err != nil {
 		return err
 	}
-	kubeNamespace := strings.TrimSuffix(string(grepResult), "\n")
-	if len(kubeNamespace) == 0 {
-		kubeNamespace = "sas-viya"
-	}
 
 	manifestLocation := fmt.Sprintf(`
 Kubernetes manifests have been created: %s
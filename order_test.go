@@ -0,0 +1,139 @@
+// order_test.go
+// Tests the playbook and usermods helpers of the software order.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestConvertInventoryUnderscores(t *testing.T) {
+	tests := []struct {
+		description string
+		inventory   string
+		groupVars   []string // group_vars files of the playbook
+		converted   string
+		copied      []string // group_vars files that are copied to their dashed names
+	}{
+		{
+			description: "host names and groups",
+			inventory:   "[sas_casserver_primary]\nsas_casserver_primary\n[sas_all:children]\nsas_casserver_primary\n",
+			groupVars:   []string{"sas_casserver_primary", "sas_all"},
+			converted:   "[sas-casserver-primary]\nsas-casserver-primary\n[sas-all:children]\nsas-casserver-primary\n",
+			copied:      []string{"sas-casserver-primary", "sas-all"},
+		},
+		{
+			description: "a longer name that starts with a shorter name",
+			inventory:   "sas_casserver sas_casserver_primary\n[sas_casserver_primary]\nsas_casserver_primary\n",
+			converted:   "sas-casserver sas-casserver-primary\n[sas-casserver-primary]\nsas-casserver-primary\n",
+		},
+		{
+			description: "only the sas_ hosts are changed",
+			inventory:   "deployTarget ansible_connection=local\n[consul]\nconsul_server\n[sas_all:children]\nconsul\n",
+			converted:   "deployTarget ansible_connection=local\n[consul]\nconsul_server\n[sas-all:children]\nconsul\n",
+		},
+		{
+			description: "group_vars without a host are not copied",
+			inventory:   "sas_httpproxy\n",
+			groupVars:   []string{"sas_other"},
+			converted:   "sas-httpproxy\n",
+		},
+	}
+	for _, test := range tests {
+		playbookPath := t.TempDir()
+		writeTestFile(t, filepath.Join(playbookPath, "inventory.ini"), test.inventory)
+		for _, host := range test.groupVars {
+			writeTestFile(t, filepath.Join(playbookPath, "group_vars", host), "host: "+host+"\n")
+		}
+
+		err := convertInventoryUnderscores(playbookPath)
+		if err != nil {
+			t.Errorf("%s: %v", test.description, err)
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(playbookPath, "inventory.ini"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != test.converted {
+			t.Errorf("%s: inventory.ini =\n%s\nwant\n%s", test.description, content, test.converted)
+		}
+
+		// The group_vars files with the old names are kept
+		for _, host := range test.groupVars {
+			if !fileExists(filepath.Join(playbookPath, "group_vars", host)) {
+				t.Errorf("%s: group_vars/%s was removed", test.description, host)
+			}
+		}
+		for index, host := range test.copied {
+			content, err := ioutil.ReadFile(filepath.Join(playbookPath, "group_vars", host))
+			if want := "host: " + test.groupVars[index] + "\n"; err != nil || string(content) != want {
+				t.Errorf("%s: group_vars/%s = %q (%v), want %q", test.description, host, content, err, want)
+			}
+		}
+	}
+
+	if err := convertInventoryUnderscores(t.TempDir()); err == nil {
+		t.Error("a playbook without an inventory.ini: want an error")
+	}
+}
+
+func TestGetManifestsUsermod(t *testing.T) {
+	tests := []struct {
+		description string
+		usermods    string // Content of manifests_usermods.yml, or empty for no file
+		key         string
+		value       string
+		err         string
+	}{
+		{description: "no file", key: "SAS_MANIFEST_DIR", value: "manifests"},
+		{description: "value is set", usermods: "SAS_MANIFEST_DIR: kubernetes\n", key: "SAS_MANIFEST_DIR", value: "kubernetes"},
+		{description: "value is not set", usermods: "SAS_K8S_NAMESPACE: viya\n", key: "SAS_MANIFEST_DIR", value: "manifests"},
+		{description: "empty value", usermods: "SAS_MANIFEST_DIR:\n", key: "SAS_MANIFEST_DIR", value: "manifests"},
+		{description: "empty string", usermods: "SAS_MANIFEST_DIR: \"\"\n", key: "SAS_MANIFEST_DIR", value: "manifests"},
+		{description: "number", usermods: "SAS_MANIFEST_DIR: 2019\n", key: "SAS_MANIFEST_DIR", value: "2019"},
+		{description: "only comments", usermods: "# SAS_MANIFEST_DIR: kubernetes\n", key: "SAS_MANIFEST_DIR", value: "manifests"},
+		{description: "invalid YAML", usermods: "SAS_MANIFEST_DIR: [kubernetes\n", key: "SAS_MANIFEST_DIR", err: "Unable to read"},
+	}
+	for _, test := range tests {
+		order := &SoftwareOrder{BuildPath: t.TempDir() + "/"}
+		if len(test.usermods) > 0 {
+			writeTestFile(t, order.BuildPath+"manifests_usermods.yml", test.usermods)
+		}
+
+		value, err := order.getManifestsUsermod(test.key, "manifests")
+		if !errorContains(err, test.err) {
+			t.Errorf("%s: error = %v, want %q", test.description, err, test.err)
+			continue
+		}
+		if value != test.value {
+			t.Errorf("%s: value = %q, want %q", test.description, value, test.value)
+		}
+	}
+}
+
+// writeTestFile writes the content to a file, and creates its directory
+func writeTestFile(t *testing.T, filePath string, content string) {
+	createTree(t, filepath.Dir(filePath), nil)
+	err := ioutil.WriteFile(filePath, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
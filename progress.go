@@ -0,0 +1,280 @@
+// progress.go
+// Shows the progress of the container builds. On a terminal each container
+// has its own line, otherwise the progress is written as plain log lines.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProgressRefresh is how often the container lines are redrawn on a terminal
+const ProgressRefresh = 500 * time.Millisecond
+
+// Terminal control sequences: move the cursor up a number of lines, and clear from the cursor to the end of the screen
+const (
+	terminalCursorUp   = "\033[%dA"
+	terminalClearBelow = "\033[J"
+)
+
+// progressLayerWidth is the widest role layer that is shown before it is shortened
+const progressLayerWidth = 40
+
+// ProgressView keeps the state of each container build. The workers update it
+// through Update, which copies the container's details, so drawing the view never
+// reads a container that a worker is changing.
+type ProgressView struct {
+	Interactive bool // Set when stdout is a terminal. Otherwise the progress is written as plain log lines
+
+	lock  sync.Mutex
+	out   io.Writer
+	names []string
+	lines map[string]*progressLine
+	drawn int // Number of lines that were drawn last, which are cleared before the next draw
+}
+
+// progressLine is the state of a single container build
+type progressLine struct {
+	status     State
+	step       string
+	layer      string
+	buildStart time.Time
+	buildEnd   time.Time
+	pushStart  time.Time
+	pushEnd    time.Time
+	imageSize  int64
+	updated    time.Time // When the container's state or step last changed
+}
+
+// NewProgressView creates a view with a line for each container that is set to be built
+func NewProgressView(containers map[string]*Container) *ProgressView {
+	view := &ProgressView{
+		Interactive: isTerminal(os.Stdout),
+		out:         os.Stdout,
+		lines:       make(map[string]*progressLine),
+	}
+	for name, container := range containers {
+		if container.Status == DoNotBuild {
+			continue
+		}
+		view.names = append(view.names, name)
+		view.lines[name] = &progressLine{status: container.Status}
+	}
+	sort.Strings(view.names)
+	return view
+}
+
+// isTerminal checks whether the file is a terminal that can redraw lines
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
+
+// Update copies the state of the container into the view. It is called by the worker that builds the container.
+func (view *ProgressView) Update(container *Container) {
+	if view == nil {
+		return
+	}
+	view.lock.Lock()
+	defer view.lock.Unlock()
+	line, found := view.lines[container.Name]
+	if !found {
+		return
+	}
+	line.status = container.Status
+	line.step = container.BuildStep
+	line.layer = container.BuildLayer
+	line.buildStart = container.BuildStart
+	line.buildEnd = container.BuildEnd
+	line.pushStart = container.PushStart
+	line.pushEnd = container.PushEnd
+	line.imageSize = container.ImageSize
+	line.updated = time.Now()
+}
+
+// ContainerStatus is the state of a single container build in the status endpoint
+type ContainerStatus struct {
+	Name         string     `json:"name"`
+	State        string     `json:"state"`
+	Step         string     `json:"step,omitempty"`
+	Layer        string     `json:"layer,omitempty"`
+	BuildStart   *time.Time `json:"build_start,omitempty"`
+	BuildSeconds float64    `json:"build_seconds,omitempty"` // Time so far while the image is being built
+	PushSeconds  float64    `json:"push_seconds,omitempty"`  // Time so far while the image is being pushed
+	ImageSize    int64      `json:"image_size,omitempty"`
+	Updated      *time.Time `json:"updated,omitempty"` // When the state or step last changed
+}
+
+// Snapshot gets a copy of the state of each container, sorted by name
+func (view *ProgressView) Snapshot() []ContainerStatus {
+	if view == nil {
+		return []ContainerStatus{}
+	}
+	view.lock.Lock()
+	defer view.lock.Unlock()
+	now := time.Now()
+	statuses := []ContainerStatus{}
+	for _, name := range view.names {
+		line := view.lines[name]
+		status := ContainerStatus{
+			Name:         name,
+			State:        line.status.String(),
+			Step:         line.step,
+			Layer:        line.layer,
+			BuildSeconds: elapsedSeconds(line.buildStart, line.buildEnd, now),
+			PushSeconds:  elapsedSeconds(line.pushStart, line.pushEnd, now),
+			ImageSize:    line.imageSize,
+		}
+		if !line.buildStart.IsZero() {
+			buildStart := line.buildStart
+			status.BuildStart = &buildStart
+		}
+		if !line.updated.IsZero() {
+			updated := line.updated
+			status.Updated = &updated
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// elapsedSeconds gets the seconds between the start and the end, or between the start and now if it has not ended
+func elapsedSeconds(start time.Time, end time.Time, now time.Time) float64 {
+	if start.IsZero() {
+		return 0
+	}
+	if end.IsZero() {
+		end = now
+	}
+	return end.Sub(start).Seconds()
+}
+
+// Message writes a log line. On a terminal the line is written above the container lines.
+func (view *ProgressView) Message(message string) {
+	if view == nil || !view.Interactive {
+		log.Println(message)
+		return
+	}
+	view.lock.Lock()
+	defer view.lock.Unlock()
+	view.clear()
+	log.Println(message)
+	view.draw()
+}
+
+// Draw redraws the container lines on a terminal
+func (view *ProgressView) Draw() {
+	if view == nil || !view.Interactive {
+		return
+	}
+	view.lock.Lock()
+	defer view.lock.Unlock()
+	view.clear()
+	view.draw()
+}
+
+// clear moves the cursor to the first container line and clears the lines below it
+func (view *ProgressView) clear() {
+	if view.drawn > 0 {
+		fmt.Fprintf(view.out, terminalCursorUp, view.drawn)
+	}
+	fmt.Fprint(view.out, terminalClearBelow)
+	view.drawn = 0
+}
+
+// draw writes a line for each container: its name, state, Dockerfile step and role layer, elapsed time, and image size
+func (view *ProgressView) draw() {
+	nameWidth := 0
+	for _, name := range view.names {
+		if len(name) > nameWidth {
+			nameWidth = len(name)
+		}
+	}
+	for _, name := range view.names {
+		line := view.lines[name]
+		elapsed := ""
+		if !line.buildStart.IsZero() {
+			end := line.pushEnd
+			if end.IsZero() && line.status != Pushing {
+				end = line.buildEnd
+			}
+			if end.IsZero() {
+				end = time.Now()
+			}
+			elapsed = end.Sub(line.buildStart).Round(time.Second).String()
+		}
+		size := ""
+		if line.imageSize > 0 {
+			size = bytesToGB(line.imageSize)
+		}
+		layer := line.layer
+		if len(layer) > progressLayerWidth {
+			layer = layer[:progressLayerWidth-3] + "..."
+		}
+		fmt.Fprintf(view.out, "%-*s  %-10s %-7s %-*s %8s %9s\n",
+			nameWidth, name, line.status, line.step, progressLayerWidth, layer, elapsed, size)
+	}
+	view.drawn = len(view.names)
+}
+
+// dockerBuildStep matches a step of the Docker build output, such as "Step 7/20 : RUN ansible-playbook ..."
+var dockerBuildStep = regexp.MustCompile(`^Step (\d+/\d+) : (.*)`)
+
+// dockerBuildRole matches the role of each ansible-playbook command in a RUN step, see dockerfileRunRole
+var dockerBuildRole = regexp.MustCompile(`--extra-vars layer=(\S+)`)
+
+// parseBuildStep gets the step number and a description of the layer from a line of the Docker build
+// output. A RUN layer of roles is described like its comment in the Dockerfile, such as "sas-java role".
+func parseBuildStep(output string) (string, string, bool) {
+	match := dockerBuildStep.FindStringSubmatch(output)
+	if match == nil {
+		return "", "", false
+	}
+	roles := []string{}
+	for _, role := range dockerBuildRole.FindAllStringSubmatch(match[2], -1) {
+		roles = append(roles, role[1])
+	}
+	if len(roles) == 0 {
+		return match[1], strings.SplitN(match[2], "\n", 2)[0], true
+	}
+	layer := strings.Join(roles, ", ") + " role"
+	if len(roles) > 1 {
+		layer += "s"
+	}
+	return match[1], layer, true
+}
+
+// prefixLines adds the prefix to each line of the output so that the output of concurrent builds can be told apart
+func prefixLines(prefix string, output string) string {
+	lines := strings.Split(output, "\n")
+	for index := range lines {
+		lines[index] = prefix + lines[index]
+	}
+	return strings.Join(lines, "\n")
+}
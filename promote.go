@@ -0,0 +1,312 @@
+// promote.go
+// The `promote` command copies the images of a previous build to another
+// registry, namespace, or tag without rebuilding them, then regenerates the
+// manifests of the build for the new location.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// promoteBlobTimeout is how long a single request to a registry can take while
+// the images are promoted. Image layers can be much larger than signatures.
+const promoteBlobTimeout = time.Hour
+
+// Promote copies each image in the build report of the most recent build of the deployment type
+// to the '--docker-registry-url' and '--docker-namespace', with the '--tag' if it is set
+func Promote(arguments []string) error {
+	flags := flag.NewFlagSet("promote", flag.ContinueOnError)
+	deploymentType := flags.String("type", "full", "")
+	dockerRegistry := flags.String("docker-registry-url", "", "")
+	dockerNamespace := flags.String("docker-namespace", "", "")
+	tag := flags.String("tag", "", "")
+	err := flags.Parse(arguments)
+	if err != nil {
+		return err
+	}
+	if *deploymentType != "multiple" && *deploymentType != "full" {
+		return errors.New("a valid '--type' is required: choose between multiple or full")
+	}
+	if len(*dockerRegistry) == 0 || len(*dockerNamespace) == 0 {
+		return errors.New("the '--docker-registry-url' and '--docker-namespace' arguments are required")
+	}
+	if !regexNoSpecialCharacters.Match([]byte(*dockerNamespace)) {
+		return errors.New("The --docker-namespace argument contains invalid characters. It must contain contain only A-Z, a-z, 0-9, _, ., or -")
+	}
+	if len(*tag) > 0 && !regexNoSpecialCharacters.Match([]byte(*tag)) {
+		return errors.New("The --tag argument contains invalid characters. It must contain contain only A-Z, a-z, 0-9, _, ., or -")
+	}
+
+	buildPath := fmt.Sprintf("builds/%s/", *deploymentType)
+	report, err := readBuildReport(buildPath + BuildReportFileName)
+	if err != nil {
+		return fmt.Errorf("%s. Only a build that pushed its images can be promoted", err.Error())
+	}
+	notPushed := []string{}
+	for _, image := range report.Images {
+		if len(image.Digest) == 0 || (image.Status != Pushed.String() && image.Status != Retagged.String()) {
+			notPushed = append(notPushed, image.Name)
+		}
+	}
+	if len(notPushed) > 0 || len(report.Images) == 0 {
+		return fmt.Errorf("Only a build that pushed all of its images can be promoted. The images that were not pushed: %s",
+			strings.Join(notPushed, ", "))
+	}
+
+	target := &SoftwareOrder{DockerRegistry: *dockerRegistry, DockerNamespace: *dockerNamespace}
+	targetRegistry, err := target.promoteRegistryClient()
+	if err != nil {
+		return err
+	}
+	sourceRegistries := make(map[string]*registryClient)
+	for _, image := range report.Images {
+		sourceRegistryURL, sourceRepository, sourceTag := splitImageName(image.Image)
+		sourceRegistry, found := sourceRegistries[sourceRegistryURL]
+		if !found {
+			source := &SoftwareOrder{DockerRegistry: sourceRegistryURL, DockerNamespace: path.Dir(sourceRepository)}
+			sourceRegistry, err = source.promoteRegistryClient()
+			if err != nil {
+				return err
+			}
+			sourceRegistries[sourceRegistryURL] = sourceRegistry
+		}
+
+		targetRepository := *dockerNamespace + "/" + path.Base(sourceRepository)
+		targetTag := sourceTag
+		if len(*tag) > 0 {
+			targetTag = *tag
+		}
+		targetImage := fmt.Sprintf("%s/%s:%s", *dockerRegistry, targetRepository, targetTag)
+		if targetImage == image.Image {
+			return fmt.Errorf("%s is already in the '--docker-registry-url' and '--docker-namespace' with the same tag", image.Image)
+		}
+
+		digest, err := copyManifest(sourceRegistry, sourceRepository, targetRegistry, targetRepository, image.Digest, targetTag)
+		if err != nil {
+			return fmt.Errorf("Unable to promote %s to %s. %s", image.Image, targetImage, err.Error())
+		}
+
+		// A signature is stored with a tag that is made from the digest, which does not change in the promotion
+		if len(image.SignatureDigest) > 0 {
+			signatureTag := strings.Replace(image.Digest, ":", "-", 1) + ".sig"
+			_, err = copyManifest(sourceRegistry, sourceRepository, targetRegistry, targetRepository, image.SignatureDigest, signatureTag)
+			if err != nil {
+				return fmt.Errorf("Unable to promote the signature of %s to %s. %s", image.Image, targetImage, err.Error())
+			}
+		}
+		fmt.Printf("%s -> %s@%s\n", image.Image, targetImage, digest)
+	}
+
+	return promoteManifests(*deploymentType, *dockerRegistry, *dockerNamespace, *tag)
+}
+
+// promoteRegistryClient reads the credentials of the order's registry with LoadRegistryAuth and creates a client for it
+func (order *SoftwareOrder) promoteRegistryClient() (*registryClient, error) {
+	fail := make(chan string, 1)
+	done := make(chan int, 1)
+	order.LoadRegistryAuth(fail, done)
+	select {
+	case failure := <-fail:
+		return nil, fmt.Errorf("Unable to read the credentials of %s. %s", order.DockerRegistry, failure)
+	case <-done:
+	}
+	registry, err := newRegistryClient(order.DockerRegistry, order.RegistryAuth)
+	if err != nil {
+		return nil, err
+	}
+	registry.http.Timeout = promoteBlobTimeout
+	return registry, nil
+}
+
+// copyManifest copies a manifest, and the manifests and blobs that it refers to, from the source repository to
+// the target repository. The manifest is pushed with the target reference, and its digest is returned.
+func copyManifest(source *registryClient, sourceRepository string, target *registryClient, targetRepository string,
+	reference string, targetReference string) (string, error) {
+	mediaType, manifest, err := source.GetManifest(sourceRepository, reference)
+	if err != nil {
+		return "", err
+	}
+	content := struct {
+		Config    *ociDescriptor  `json:"config"`
+		Layers    []ociDescriptor `json:"layers"`
+		Manifests []ociDescriptor `json:"manifests"` // Set in a manifest list, which has a manifest for each platform
+	}{}
+	err = json.Unmarshal(manifest, &content)
+	if err != nil {
+		return "", fmt.Errorf("unable to read the manifest %s of %s, %s", reference, sourceRepository, err.Error())
+	}
+
+	for _, child := range content.Manifests {
+		_, err = copyManifest(source, sourceRepository, target, targetRepository, child.Digest, child.Digest)
+		if err != nil {
+			return "", err
+		}
+	}
+	blobs := content.Layers
+	if content.Config != nil {
+		blobs = append(blobs, *content.Config)
+	}
+	for _, blob := range blobs {
+		err = copyBlob(source, sourceRepository, target, targetRepository, blob.Digest)
+		if err != nil {
+			return "", err
+		}
+	}
+	return target.PushManifest(targetRepository, targetReference, mediaType, manifest)
+}
+
+// copyBlob copies a blob to the target repository unless it is already there. Within one registry the
+// blob is mounted from the source repository, otherwise it is streamed from the source registry.
+func copyBlob(source *registryClient, sourceRepository string, target *registryClient, targetRepository string, digest string) error {
+	found, err := target.HasBlob(targetRepository, digest)
+	if err != nil || found {
+		return err
+	}
+	if source.BaseURL == target.BaseURL {
+		mounted, err := target.MountBlob(targetRepository, digest, sourceRepository)
+		if err == nil && mounted {
+			return nil
+		}
+	}
+
+	content, size, err := source.GetBlob(sourceRepository, digest)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	return target.PushBlobStream(targetRepository, digest, size, content)
+}
+
+// promoteManifests points the manifest variables of the build at the promoted images, then
+// generates the manifests again in the same way as the '--generate-manifests-only' argument
+func promoteManifests(deploymentType string, dockerRegistry string, dockerNamespace string, tag string) error {
+	order := &SoftwareOrder{
+		DeploymentType:        deploymentType,
+		DockerRegistry:        dockerRegistry,
+		DockerNamespace:       dockerNamespace,
+		GenerateManifestsOnly: true,
+		BuildPath:             fmt.Sprintf("builds/%s/", deploymentType),
+		TimestampTag:          time.Now().Format("2006-01-02-15-04-05"),
+	}
+	err := order.DefineManifestDir()
+	if err != nil {
+		return err
+	}
+
+	err = setYAMLValues(order.BuildPath+"manifest-vars.yml", map[string]string{
+		"registries.docker-registry.url":       dockerRegistry,
+		"registries.docker-registry.namespace": dockerNamespace,
+	})
+	if err != nil {
+		return err
+	}
+	if len(tag) > 0 {
+		err = setYAMLValues(order.BuildPath+"vars_deployment.yml", map[string]string{"docker_tag": tag})
+		if err != nil {
+			return err
+		}
+	}
+	err = order.GenerateManifests()
+	if err != nil {
+		return err
+	}
+	if order.Log != nil {
+		order.Log.Close()
+	}
+	fmt.Printf("The manifests in %s%s use the promoted images\n", order.BuildPath, order.ManifestDir)
+	return nil
+}
+
+// setYAMLValues sets values in a yaml file. Each key is a path of map keys separated by dots.
+// The order of the keys in the file is kept.
+func setYAMLValues(filePath string, values map[string]string) error {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	document := yaml.MapSlice{}
+	err = yaml.Unmarshal(content, &document)
+	if err != nil {
+		return fmt.Errorf("unable to read %s, %s", filePath, err.Error())
+	}
+	for key, value := range values {
+		document, err = setMapSliceValue(document, strings.Split(key, "."), value)
+		if err != nil {
+			return fmt.Errorf("unable to set %s in %s, %s", key, filePath, err.Error())
+		}
+	}
+	content, err = yaml.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filePath, content, 0644)
+}
+
+// setMapSliceValue sets the value at the path of keys, and adds the keys that are not in the map yet
+func setMapSliceValue(document yaml.MapSlice, keys []string, value string) (yaml.MapSlice, error) {
+	for index, item := range document {
+		if item.Key != keys[0] {
+			continue
+		}
+		if len(keys) == 1 {
+			document[index].Value = value
+			return document, nil
+		}
+		child, isMap := item.Value.(yaml.MapSlice)
+		if !isMap && item.Value != nil {
+			return nil, fmt.Errorf("%s is not a map", keys[0])
+		}
+		child, err := setMapSliceValue(child, keys[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		document[index].Value = child
+		return document, nil
+	}
+
+	if len(keys) == 1 {
+		return append(document, yaml.MapItem{Key: keys[0], Value: value}), nil
+	}
+	child, err := setMapSliceValue(yaml.MapSlice{}, keys[1:], value)
+	if err != nil {
+		return nil, err
+	}
+	return append(document, yaml.MapItem{Key: keys[0], Value: child}), nil
+}
+
+// splitImageName splits a <registry>/<repository>:<tag> image name
+func splitImageName(image string) (string, string, string) {
+	repository := imageRepository(image)
+	tag := strings.TrimPrefix(strings.TrimPrefix(image, repository), ":")
+	registry := ""
+	if separator := strings.Index(repository, "/"); separator >= 0 {
+		registry = repository[:separator]
+		repository = repository[separator+1:]
+	}
+	return registry, repository, tag
+}
@@ -0,0 +1,346 @@
+// registry.go
+// A small client for the Docker Registry HTTP API V2, used to push content
+// that is not an image built by the Docker daemon, such as image signatures,
+// to tag the images that have not changed since the previous build, and to
+// copy images between registries.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// registryClient pushes blobs and manifests to a Docker registry and gets manifests from it
+type registryClient struct {
+	BaseURL  string // https://<registry>
+	Username string
+	Password string
+	token    string // Bearer token from the registry's token service, if it uses one
+	http     *http.Client
+}
+
+// newRegistryClient creates a client for the registry. The auth is the
+// base64 encoded credentials that LoadRegistryAuth reads from the Docker config.
+func newRegistryClient(registry string, auth string) (*registryClient, error) {
+	client := &registryClient{
+		BaseURL: "https://" + strings.TrimPrefix(strings.TrimSuffix(registry, "/"), "https://"),
+		http:    &http.Client{Timeout: 5 * time.Minute},
+	}
+	if len(auth) > 0 {
+		authBytes, err := base64.StdEncoding.DecodeString(auth)
+		if err != nil {
+			return nil, err
+		}
+		credentials := struct {
+			Username string
+			Password string
+		}{}
+		err = json.Unmarshal(authBytes, &credentials)
+		if err != nil {
+			return nil, err
+		}
+		client.Username = credentials.Username
+		client.Password = credentials.Password
+	}
+	return client, nil
+}
+
+// PushBlob uploads the content to the repository, unless the registry already has it, and returns its digest
+func (registry *registryClient) PushBlob(repository string, content []byte) (string, error) {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+	found, err := registry.HasBlob(repository, digest)
+	if err != nil || found {
+		return digest, err
+	}
+
+	// Start an upload then finish it with a single PUT of the whole blob
+	location, err := registry.startUpload(repository, digest)
+	if err != nil {
+		return "", err
+	}
+	response, err := registry.do(repository, "PUT", location, "application/octet-stream", content)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		return "", registryError("upload blob "+digest+" to "+repository, response)
+	}
+	return digest, nil
+}
+
+// HasBlob checks whether the repository has the blob
+func (registry *registryClient) HasBlob(repository string, digest string) (bool, error) {
+	response, err := registry.do(repository, "HEAD", "/v2/"+repository+"/blobs/"+digest, "", nil)
+	if err != nil {
+		return false, err
+	}
+	response.Body.Close()
+	return response.StatusCode == http.StatusOK, nil
+}
+
+// GetBlob downloads a blob from the repository. The caller closes the content.
+func (registry *registryClient) GetBlob(repository string, digest string) (io.ReadCloser, int64, error) {
+	response, err := registry.do(repository, "GET", "/v2/"+repository+"/blobs/"+digest, "", nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		return nil, 0, registryError("get blob "+digest+" from "+repository, response)
+	}
+	return response.Body, response.ContentLength, nil
+}
+
+// MountBlob asks the registry to add a blob from another of its repositories to the repository
+// without uploading it. It returns false if the registry did not mount the blob.
+func (registry *registryClient) MountBlob(repository string, digest string, fromRepository string) (bool, error) {
+	query := url.Values{"mount": {digest}, "from": {fromRepository}}
+	response, err := registry.do(repository, "POST", "/v2/"+repository+"/blobs/uploads/?"+query.Encode(), "", nil)
+	if err != nil {
+		return false, err
+	}
+	response.Body.Close()
+	return response.StatusCode == http.StatusCreated, nil
+}
+
+// PushBlobStream uploads a blob of the given size from a stream, which is used for image
+// layers that are too large to keep in memory
+func (registry *registryClient) PushBlobStream(repository string, digest string, size int64, content io.Reader) error {
+	location, err := registry.startUpload(repository, digest)
+	if err != nil {
+		return err
+	}
+
+	// A stream cannot be sent twice, so the credentials from starting the upload are used
+	request, err := http.NewRequest("PUT", location, content)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = size
+	request.Header.Set("Content-Type", "application/octet-stream")
+	registry.authorize(request)
+	response, err := registry.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		return registryError("upload blob "+digest+" to "+repository, response)
+	}
+	return nil
+}
+
+// startUpload starts a blob upload and gets the URL that the blob with the digest is PUT to
+func (registry *registryClient) startUpload(repository string, digest string) (string, error) {
+	response, err := registry.do(repository, "POST", "/v2/"+repository+"/blobs/uploads/", "", nil)
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusAccepted {
+		return "", registryError("start blob upload to "+repository, response)
+	}
+	location, err := url.Parse(response.Header.Get("Location"))
+	if err != nil {
+		return "", err
+	}
+	location = response.Request.URL.ResolveReference(location)
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+	return location.String(), nil
+}
+
+// PushManifest uploads the manifest to the repository with the tag or digest
+// as its reference and returns the digest of the manifest
+func (registry *registryClient) PushManifest(repository string, reference string, mediaType string, content []byte) (string, error) {
+	response, err := registry.do(repository, "PUT", "/v2/"+repository+"/manifests/"+reference, mediaType, content)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		return "", registryError("push manifest "+reference+" to "+repository, response)
+	}
+	digest := response.Header.Get("Docker-Content-Digest")
+	if len(digest) == 0 {
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+	}
+	return digest, nil
+}
+
+// manifestMediaTypes are the manifest formats that GetManifest accepts
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	ociManifestMediaType,
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// GetManifest downloads the manifest with the tag or digest as its reference
+// and returns the media type and the content of the manifest
+func (registry *registryClient) GetManifest(repository string, reference string) (string, []byte, error) {
+	response, err := registry.do(repository, "GET", "/v2/"+repository+"/manifests/"+reference, strings.Join(manifestMediaTypes, ", "), nil)
+	if err != nil {
+		return "", nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", nil, registryError("get manifest "+reference+" from "+repository, response)
+	}
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	if strings.HasPrefix(reference, "sha256:") && fmt.Sprintf("sha256:%x", sha256.Sum256(content)) != reference {
+		return "", nil, fmt.Errorf("the manifest %s from %s does not match its digest", reference, repository)
+	}
+	return response.Header.Get("Content-Type"), content, nil
+}
+
+// do sends a request to the registry. If the registry asks for credentials
+// then the request is sent again with a token or with basic authentication.
+func (registry *registryClient) do(repository string, method string, path string, contentType string, content []byte) (*http.Response, error) {
+	requestURL := path
+	if strings.HasPrefix(path, "/") {
+		requestURL = registry.BaseURL + path
+	}
+
+	response, err := registry.send(method, requestURL, contentType, content)
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+	response.Body.Close()
+
+	challenge := response.Header.Get("WWW-Authenticate")
+	if strings.HasPrefix(strings.ToLower(challenge), "bearer") {
+		err = registry.getToken(challenge, repository)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(registry.Username) == 0 {
+		return nil, fmt.Errorf("the registry %s requires a login. Run `docker login` before building", registry.BaseURL)
+	}
+	return registry.send(method, requestURL, contentType, content)
+}
+
+// send makes a single request with the current credentials. A request
+// without content uses the content type as the media types that it accepts.
+func (registry *registryClient) send(method string, requestURL string, contentType string, content []byte) (*http.Response, error) {
+	var body io.Reader
+	if content != nil {
+		body = bytes.NewReader(content)
+	}
+	request, err := http.NewRequest(method, requestURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(contentType) > 0 && content != nil {
+		request.Header.Set("Content-Type", contentType)
+	} else if len(contentType) > 0 {
+		request.Header.Set("Accept", contentType)
+	}
+	registry.authorize(request)
+	return registry.http.Do(request)
+}
+
+// authorize adds the current credentials to the request
+func (registry *registryClient) authorize(request *http.Request) {
+	if len(registry.token) > 0 {
+		request.Header.Set("Authorization", "Bearer "+registry.token)
+	} else if len(registry.Username) > 0 {
+		request.SetBasicAuth(registry.Username, registry.Password)
+	}
+}
+
+// challengeParameter matches a key="value" pair in a WWW-Authenticate header
+var challengeParameter = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// getToken gets a token from the token service that is named in the registry's Bearer challenge, such as
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:samalba/my-app:pull,push"
+func (registry *registryClient) getToken(challenge string, repository string) error {
+	parameters := map[string]string{}
+	for _, match := range challengeParameter.FindAllStringSubmatch(challenge, -1) {
+		parameters[match[1]] = match[2]
+	}
+	realm, found := parameters["realm"]
+	if !found {
+		return fmt.Errorf("the registry %s did not give a token service: %s", registry.BaseURL, challenge)
+	}
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return err
+	}
+	query := tokenURL.Query()
+	if service, found := parameters["service"]; found {
+		query.Set("service", service)
+	}
+	scope, found := parameters["scope"]
+	if !found {
+		scope = "repository:" + repository + ":pull,push"
+	}
+	query.Set("scope", scope)
+	tokenURL.RawQuery = query.Encode()
+
+	request, err := http.NewRequest("GET", tokenURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if len(registry.Username) > 0 {
+		request.SetBasicAuth(registry.Username, registry.Password)
+	}
+	response, err := registry.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return registryError("get a token from "+realm, response)
+	}
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	err = json.NewDecoder(response.Body).Decode(&token)
+	if err != nil {
+		return err
+	}
+	registry.token = token.Token
+	if len(registry.token) == 0 {
+		registry.token = token.AccessToken
+	}
+	return nil
+}
+
+// registryError describes a response with an unexpected status
+func registryError(action string, response *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	return fmt.Errorf("unable to %s: %s %s", action, response.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,123 @@
+// report.go
+// Writes the build-report.json file, which records each image that was
+// built along with where it was pushed and the files created for it.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// BuildReportFileName is written to the top of the build directory
+const BuildReportFileName = "build-report.json"
+
+// BuildReport is the content of the build-report.json file
+type BuildReport struct {
+	RecipeVersion     string                 `json:"recipe_version"`
+	GitSHA            string                 `json:"git_sha,omitempty"`
+	DeploymentType    string                 `json:"deployment_type"`
+	OrchestrationTool *OrchestrationToolInfo `json:"orchestration_tool,omitempty"`
+	StartTime         time.Time              `json:"start_time"`
+	EndTime           time.Time              `json:"end_time"`
+	Images            []ImageReport          `json:"images"`
+}
+
+// ImageReport is the build result of a single container
+type ImageReport struct {
+	Name            string         `json:"name"`
+	Image           string         `json:"image"`
+	Status          string         `json:"status"`
+	Digest          string         `json:"digest,omitempty"`
+	Size            int64          `json:"size,omitempty"`
+	BuildSeconds    float64        `json:"build_seconds,omitempty"`
+	PushSeconds     float64        `json:"push_seconds,omitempty"`
+	ContextHash     string         `json:"context_sha256,omitempty"`
+	Fingerprint     string         `json:"fingerprint,omitempty"`
+	SBOM            string         `json:"sbom,omitempty"`
+	SignatureDigest string         `json:"signature_digest,omitempty"`
+	Vulnerabilities map[string]int `json:"vulnerabilities,omitempty"`
+	Error           string         `json:"error,omitempty"` // Why the image failed, such as a build that timed out
+}
+
+// WriteBuildReport writes the build-report.json file with each container that was set to be built
+func (order *SoftwareOrder) WriteBuildReport() error {
+	report := BuildReport{
+		RecipeVersion:  RecipeVersion,
+		GitSHA:         order.GitSHA,
+		DeploymentType: order.DeploymentType,
+		StartTime:      order.StartTime,
+		EndTime:        order.EndTime,
+		Images:         []ImageReport{},
+	}
+	if len(order.OrchestrationToolInfo.SHA256) > 0 {
+		report.OrchestrationTool = &order.OrchestrationToolInfo
+	}
+
+	for _, container := range order.Containers {
+		if container.Status == DoNotBuild {
+			continue
+		}
+		image := ImageReport{
+			Name:            container.Name,
+			Image:           container.GetWholeImageName(),
+			Status:          container.Status.String(),
+			Digest:          container.Digest,
+			Size:            container.ImageSize,
+			ContextHash:     container.ContextHash,
+			Fingerprint:     container.Fingerprint,
+			SBOM:            container.SBOMPath,
+			SignatureDigest: container.SignatureDigest,
+			Vulnerabilities: container.ScanCounts,
+			Error:           container.FailureReason,
+		}
+		if !container.BuildEnd.IsZero() {
+			image.BuildSeconds = container.BuildEnd.Sub(container.BuildStart).Seconds()
+		}
+		if !container.PushEnd.IsZero() {
+			image.PushSeconds = container.PushEnd.Sub(container.PushStart).Seconds()
+		}
+		report.Images = append(report.Images, image)
+	}
+	sort.Slice(report.Images, func(i, j int) bool {
+		return report.Images[i].Name < report.Images[j].Name
+	})
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(order.BuildPath+BuildReportFileName, content, 0644)
+}
+
+// readBuildReport reads the build-report.json file of a build
+func readBuildReport(reportPath string) (*BuildReport, error) {
+	content, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		return nil, err
+	}
+	report := &BuildReport{}
+	err = json.Unmarshal(content, report)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s, %s", reportPath, err.Error())
+	}
+	return report, nil
+}
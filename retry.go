@@ -0,0 +1,152 @@
+// retry.go
+// Tries a Docker push or pull again after a transient failure, such as a
+// connection reset while a large image is pushed to the registry.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// retryMaxDelay is the longest wait between two attempts
+const retryMaxDelay = 2 * time.Minute
+
+// fatalErrors are the parts of the error messages that will not change by trying again,
+// such as a registry that rejects the credentials. They are checked before transientErrors.
+var fatalErrors = []string{
+	"unauthorized",
+	"authentication required",
+	"denied",
+	"forbidden",
+	"name unknown",
+	"manifest unknown",
+	"not found",
+	"invalid reference format",
+}
+
+// transientErrors are the parts of the error messages of network failures and
+// registry errors that can succeed when they are tried again
+var transientErrors = []string{
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"unexpected eof",
+	"i/o timeout",
+	"tls handshake timeout",
+	"no such host",
+	"blob upload unknown",
+	"blob upload invalid",
+	"toomanyrequests",
+	"too many requests",
+	"500 internal server error",
+	"502 bad gateway",
+	"503 service unavailable",
+	"504 gateway timeout",
+	"status: 5", // Such as "received unexpected HTTP status: 500 Internal Server Error"
+	"status code 5",
+}
+
+// RetryPolicy is how often a Docker push or pull is tried again after a transient failure
+type RetryPolicy struct {
+	Retries int           // Number of times a call is tried again after the first attempt
+	Delay   time.Duration // Wait before the first retry, which doubles with each retry up to retryMaxDelay
+}
+
+// RetryPolicy gets the policy that is set by the --retries and --retry-delay arguments
+func (order *SoftwareOrder) RetryPolicy() RetryPolicy {
+	return RetryPolicy{Retries: order.Retries, Delay: order.RetryDelay}
+}
+
+// Do runs the call until it succeeds, it fails with an error that is not transient, the retries are used up,
+// or the context is done. Each failed attempt is described to the log function, and the last error is returned.
+func (policy RetryPolicy) Do(ctx context.Context, operation string, log func(string), call func() error) error {
+	attempts := policy.Retries + 1
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil {
+			if attempt > 1 {
+				log(fmt.Sprintf("The %s succeeded on attempt %d of %d", operation, attempt, attempts))
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		// The first line has the reason, the rest of a Docker stream error points to the container's log
+		message := strings.SplitN(strings.TrimSpace(err.Error()), "\n", 2)[0]
+		if !isTransientError(err) {
+			log(fmt.Sprintf("The %s failed on attempt %d of %d and will not be tried again: %s", operation, attempt, attempts, message))
+			return err
+		}
+		if attempt >= attempts {
+			log(fmt.Sprintf("The %s failed on attempt %d of %d: %s", operation, attempt, attempts, message))
+			return err
+		}
+
+		delay := policy.backoff(attempt)
+		log(fmt.Sprintf("The %s failed on attempt %d of %d, trying again in %s: %s",
+			operation, attempt, attempts, delay.Round(time.Millisecond), message))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff gets the wait after the attempt. The delay doubles with each attempt, and a random
+// part of up to half of it is taken off so that the workers do not all try again at once.
+func (policy RetryPolicy) backoff(attempt int) time.Duration {
+	delay := policy.Delay
+	for i := 1; i < attempt && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// isTransientError checks whether a failed push or pull can succeed when it is tried again
+func isTransientError(err error) bool {
+	message := strings.ToLower(err.Error())
+	for _, fatal := range fatalErrors {
+		if strings.Contains(message, fatal) {
+			return false
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	for _, transient := range transientErrors {
+		if strings.Contains(message, transient) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+// retry_test.go
+// Tests which Docker push and pull failures are tried again, and how long the retries wait.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// timeoutError is a net.Error whose message does not say that it timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "read tcp 10.0.0.1:5000: operation was canceled" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{err: errors.New("received unexpected HTTP status: 503 Service Unavailable"), transient: true},
+		{err: errors.New("Get https://registry/v2/: net/http: TLS handshake timeout"), transient: true},
+		{err: errors.New("read: Connection Reset by peer"), transient: true},
+		{err: errors.New("toomanyrequests: rate limit exceeded"), transient: true},
+		{err: errors.New("status code 502"), transient: true},
+		{err: errors.New("denied: requested access to the resource is denied"), transient: false},
+		{err: errors.New("denied: 503 Service Unavailable"), transient: false},
+		{err: errors.New("unauthorized: authentication required"), transient: false},
+		{err: errors.New("manifest unknown: manifest unknown"), transient: false},
+		{err: errors.New("invalid reference format"), transient: false},
+		{err: errors.New("no space left on device"), transient: false},
+		{err: timeoutError{}, transient: true},
+		{err: fmt.Errorf("pushing the layer, %w", timeoutError{}), transient: true},
+		{err: fmt.Errorf("denied, %w", timeoutError{}), transient: false},
+	}
+	for _, test := range tests {
+		if transient := isTransientError(test.err); transient != test.transient {
+			t.Errorf("isTransientError(%q) = %t, want %t", test.err, transient, test.transient)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		delay   time.Duration
+		attempt int
+		max     time.Duration // The delay before a random part of up to half of it is taken off
+	}{
+		{delay: 5 * time.Second, attempt: 1, max: 5 * time.Second},
+		{delay: 5 * time.Second, attempt: 2, max: 10 * time.Second},
+		{delay: 5 * time.Second, attempt: 4, max: 40 * time.Second},
+		{delay: 5 * time.Second, attempt: 6, max: retryMaxDelay},
+		{delay: 5 * time.Second, attempt: 1000, max: retryMaxDelay},
+		{delay: 10 * time.Minute, attempt: 1, max: retryMaxDelay},
+		{delay: 0, attempt: 3, max: 0},
+	}
+	for _, test := range tests {
+		policy := RetryPolicy{Retries: 3, Delay: test.delay}
+		for i := 0; i < 100; i++ {
+			delay := policy.backoff(test.attempt)
+			if delay > test.max || delay < test.max/2 {
+				t.Errorf("backoff(%d) with a %s delay = %s, want between %s and %s",
+					test.attempt, test.delay, delay, test.max/2, test.max)
+				break
+			}
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	tests := []struct {
+		description string
+		errs        []error // Error of each call, where the calls after the last one succeed
+		retries     int
+		calls       int
+		err         string
+	}{
+		{description: "success", retries: 3, calls: 1},
+		{
+			description: "transient error then success",
+			errs:        []error{errors.New("502 Bad Gateway"), errors.New("connection refused")},
+			retries:     3,
+			calls:       3,
+		},
+		{
+			description: "fatal error is not tried again",
+			errs:        []error{errors.New("unauthorized: authentication required")},
+			retries:     3,
+			calls:       1,
+			err:         "unauthorized",
+		},
+		{
+			description: "retries are used up",
+			errs:        []error{errors.New("i/o timeout"), errors.New("i/o timeout"), errors.New("broken pipe")},
+			retries:     2,
+			calls:       3,
+			err:         "broken pipe",
+		},
+	}
+	for _, test := range tests {
+		calls := 0
+		policy := RetryPolicy{Retries: test.retries}
+		err := policy.Do(context.Background(), "push", func(string) {}, func() error {
+			calls++
+			if calls <= len(test.errs) {
+				return test.errs[calls-1]
+			}
+			return nil
+		})
+		if !errorContains(err, test.err) {
+			t.Errorf("%s: error = %v, want %q", test.description, err, test.err)
+		}
+		if calls != test.calls {
+			t.Errorf("%s: %d calls, want %d", test.description, calls, test.calls)
+		}
+	}
+}
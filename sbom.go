@@ -0,0 +1,494 @@
+// sbom.go
+// Writes a software bill of materials (SBOM) for each built image, in either
+// the SPDX or the CycloneDX JSON format. The SBOM lists the base image, the
+// RPM packages in the image, the addons, and the files in the Docker context.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SBOM formats set by the --sbom argument
+const (
+	SBOMFormatSPDX      = "spdx"
+	SBOMFormatCycloneDX = "cyclonedx"
+)
+
+// sbomRPMQuery lists every installed package as <name> <epoch> <version> <arch> <vendor>, separated by tabs
+var sbomRPMQuery = []string{"rpm", "--query", "--all", "--queryformat",
+	"%{NAME}\\t%{EPOCH}\\t%{VERSION}-%{RELEASE}\\t%{ARCH}\\t%{VENDOR}\\n"}
+
+// sbomPackage is an RPM package that is installed in an image
+type sbomPackage struct {
+	Name    string
+	Epoch   string // "(none)" if the package does not have an epoch
+	Version string // <version>-<release>
+	Arch    string
+	Vendor  string
+}
+
+// purl gets the package URL of the RPM, such as pkg:rpm/sas/sas-envesntl@1.0-1?arch=x86_64
+func (pkg sbomPackage) purl(platform string) string {
+	namespace := "centos"
+	if platform == "suse" {
+		namespace = "opensuse"
+	}
+	if strings.Contains(strings.ToLower(pkg.Vendor), "sas") {
+		namespace = "sas"
+	}
+	purl := fmt.Sprintf("pkg:rpm/%s/%s@%s?arch=%s",
+		namespace, url.PathEscape(pkg.Name), url.PathEscape(pkg.Version), url.QueryEscape(pkg.Arch))
+	if pkg.Epoch != "(none)" && pkg.Epoch != "0" {
+		purl += "&epoch=" + url.QueryEscape(pkg.Epoch)
+	}
+	return purl
+}
+
+// sbomContents holds what is gathered from the image and the build before it is written in a format
+type sbomContents struct {
+	ImageName       string
+	ImageTag        string
+	ImageID         string
+	BaseImage       string
+	BaseImageDigest string
+	Platform        string
+	Created         time.Time
+	Packages        []sbomPackage
+	Addons          []*Addon
+	Files           []string // Paths in the Docker context, sorted
+	FileDigests     map[string]string
+}
+
+// WriteSBOM gathers the contents of the built image and writes the SBOM to the
+// image's build directory in the format set by the --sbom argument
+func (container *Container) WriteSBOM() error {
+	contents, err := container.getSBOMContents()
+	if err != nil {
+		return err
+	}
+
+	var document interface{}
+	fileName := ""
+	switch container.SoftwareOrder.SBOMFormat {
+	case SBOMFormatSPDX:
+		document, err = newSPDXDocument(contents)
+		fileName = "sbom.spdx.json"
+	case SBOMFormatCycloneDX:
+		document, err = newCycloneDXDocument(contents)
+		fileName = "sbom.cdx.json"
+	default:
+		return fmt.Errorf("unknown SBOM format '%s'", container.SoftwareOrder.SBOMFormat)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Package URLs have a "&" between qualifiers, which is kept as-is instead of escaped
+	content := new(bytes.Buffer)
+	encoder := json.NewEncoder(content)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(document)
+	if err != nil {
+		return err
+	}
+	container.SBOMPath = container.BuildPath + "/" + fileName
+	err = ioutil.WriteFile(container.SBOMPath, content.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	container.WriteLog(fmt.Sprintf("SBOM: %d packages, %d addons, %d files written to %s",
+		len(contents.Packages), len(contents.Addons), len(contents.Files), container.SBOMPath))
+	return nil
+}
+
+// getSBOMContents inspects the built image and its base image, and lists the RPM packages in the image
+func (container *Container) getSBOMContents() (sbomContents, error) {
+	contents := sbomContents{
+		ImageName:   container.GetWholeImageName(),
+		ImageTag:    container.GetTag(),
+		BaseImage:   container.BaseImage,
+		Platform:    container.SoftwareOrder.Platform,
+		Created:     time.Now().UTC(),
+		FileDigests: container.ContextDigests,
+	}
+
+	image, _, err := container.DockerClient.ImageInspectWithRaw(container.SoftwareOrder.BuildContext, contents.ImageName)
+	if err != nil {
+		return contents, err
+	}
+	contents.ImageID = image.ID
+
+	baseImage, _, err := container.DockerClient.ImageInspectWithRaw(container.SoftwareOrder.BuildContext, container.BaseImage)
+	if err != nil {
+		return contents, err
+	}
+	contents.BaseImageDigest = baseImage.ID
+	if len(baseImage.RepoDigests) > 0 {
+		contents.BaseImageDigest = baseImage.RepoDigests[0][strings.Index(baseImage.RepoDigests[0], "@")+1:]
+	}
+
+	contents.Packages, err = container.queryImageRPMs(contents.ImageName)
+	if err != nil {
+		return contents, err
+	}
+
+	for _, addon := range container.SoftwareOrder.Addons {
+		if _, found := addon.Images[container.addonImageName()]; found {
+			contents.Addons = append(contents.Addons, addon)
+		}
+	}
+
+	for name := range container.ContextDigests {
+		contents.Files = append(contents.Files, name)
+	}
+	sort.Strings(contents.Files)
+	return contents, nil
+}
+
+// queryImageRPMs lists the packages in the image's rpmdb by running the rpm
+// command in a temporary container. This includes the packages of the base
+// image along with those installed by the sas-install roles.
+func (container *Container) queryImageRPMs(imageName string) ([]sbomPackage, error) {
+	exitCode, output, err := container.runInImage(imageName, sbomRPMQuery, "root")
+	if err != nil {
+		return nil, err
+	}
+	if exitCode != 0 {
+		return nil, fmt.Errorf("unable to list the RPM packages in %s, rpm exited with %d", imageName, exitCode)
+	}
+
+	packages := []sbomPackage{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimRight(scanner.Text(), "\r"), "\t")
+		if len(fields) != 5 {
+			continue
+		}
+		packages = append(packages, sbomPackage{Name: fields[0], Epoch: fields[1], Version: fields[2], Arch: fields[3], Vendor: fields[4]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(packages) == 0 {
+		return nil, errors.New("no RPM packages were found in " + imageName)
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].Name == packages[j].Name {
+			return packages[i].Version < packages[j].Version
+		}
+		return packages[i].Name < packages[j].Name
+	})
+	return packages, nil
+}
+
+// newUUID gets a random (version 4) UUID
+func newUUID() (string, error) {
+	bytes := make([]byte, 16)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	bytes[6] = (bytes[6] & 0x0f) | 0x40
+	bytes[8] = (bytes[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", bytes[0:4], bytes[4:6], bytes[6:8], bytes[8:10], bytes[10:]), nil
+}
+
+// spdxID gets an SPDX identifier, which may only have letters, numbers, "." and "-"
+func spdxID(kind string, name string) string {
+	id := []rune{}
+	for _, character := range name {
+		if (character >= 'a' && character <= 'z') || (character >= 'A' && character <= 'Z') ||
+			(character >= '0' && character <= '9') || character == '.' || character == '-' {
+			id = append(id, character)
+		} else {
+			id = append(id, '-')
+		}
+	}
+	// Different names can have the same identifier once the characters are replaced, so add a short hash
+	hash := sha256.Sum256([]byte(name))
+	return fmt.Sprintf("SPDXRef-%s-%s-%x", kind, string(id), hash[:4])
+}
+
+// SPDX 2.3 JSON document, see https://spdx.github.io/spdx-spec/v2.3/
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Files             []spdxFile         `json:"files,omitempty"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID                string            `json:"SPDXID"`
+	Name                  string            `json:"name"`
+	VersionInfo           string            `json:"versionInfo,omitempty"`
+	Supplier              string            `json:"supplier,omitempty"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	Description           string            `json:"description,omitempty"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+	Checksums             []spdxChecksum    `json:"checksums,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxFile struct {
+	SPDXID    string         `json:"SPDXID"`
+	FileName  string         `json:"fileName"`
+	Checksums []spdxChecksum `json:"checksums"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// newSPDXDocument describes the image as the main package, which contains the RPM packages,
+// descends from the base image, and is generated from the addons and the Docker context files
+func newSPDXDocument(contents sbomContents) (spdxDocument, error) {
+	uuid, err := newUUID()
+	if err != nil {
+		return spdxDocument{}, err
+	}
+	imageID := "SPDXRef-Image"
+	document := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              contents.ImageName,
+		DocumentNamespace: fmt.Sprintf("%s/spdx/%s-%s", RecipeSourceURL, url.PathEscape(contents.ImageName), uuid),
+		CreationInfo: spdxCreationInfo{
+			Created:  contents.Created.Format(time.RFC3339),
+			Creators: []string{"Tool: sas-container-recipes-" + RecipeVersion},
+		},
+		Relationships: []spdxRelationship{{"SPDXRef-DOCUMENT", "DESCRIBES", imageID}},
+	}
+
+	document.Packages = append(document.Packages, spdxPackage{
+		SPDXID:                imageID,
+		Name:                  contents.ImageName,
+		VersionInfo:           contents.ImageTag,
+		DownloadLocation:      "NOASSERTION",
+		PrimaryPackagePurpose: "CONTAINER",
+		Checksums:             spdxDigest(contents.ImageID),
+	})
+
+	baseImageID := spdxID("BaseImage", contents.BaseImage)
+	document.Packages = append(document.Packages, spdxPackage{
+		SPDXID:                baseImageID,
+		Name:                  contents.BaseImage,
+		DownloadLocation:      "NOASSERTION",
+		PrimaryPackagePurpose: "CONTAINER",
+		Checksums:             spdxDigest(contents.BaseImageDigest),
+	})
+	document.Relationships = append(document.Relationships, spdxRelationship{imageID, "DESCENDANT_OF", baseImageID})
+
+	for _, pkg := range contents.Packages {
+		id := spdxID("RPM", pkg.Name+"-"+pkg.Version+"."+pkg.Arch)
+		supplier := "NOASSERTION"
+		if len(pkg.Vendor) > 0 && pkg.Vendor != "(none)" {
+			supplier = "Organization: " + pkg.Vendor
+		}
+		document.Packages = append(document.Packages, spdxPackage{
+			SPDXID:           id,
+			Name:             pkg.Name,
+			VersionInfo:      pkg.Version,
+			Supplier:         supplier,
+			DownloadLocation: "NOASSERTION",
+			ExternalRefs:     []spdxExternalRef{{"PACKAGE-MANAGER", "purl", pkg.purl(contents.Platform)}},
+		})
+		document.Relationships = append(document.Relationships, spdxRelationship{imageID, "CONTAINS", id})
+	}
+
+	for _, addon := range contents.Addons {
+		id := spdxID("Addon", addon.Name)
+		document.Packages = append(document.Packages, spdxPackage{
+			SPDXID:           id,
+			Name:             addon.Name,
+			Description:      addon.Description,
+			DownloadLocation: "NOASSERTION",
+		})
+		document.Relationships = append(document.Relationships, spdxRelationship{imageID, "GENERATED_FROM", id})
+	}
+
+	for _, name := range contents.Files {
+		id := spdxID("File", name)
+		document.Files = append(document.Files, spdxFile{
+			SPDXID:    id,
+			FileName:  "./" + name,
+			Checksums: []spdxChecksum{{"SHA256", contents.FileDigests[name]}},
+		})
+		document.Relationships = append(document.Relationships, spdxRelationship{imageID, "GENERATED_FROM", id})
+	}
+	return document, nil
+}
+
+// spdxDigest converts a "sha256:<hex>" image digest into an SPDX checksum
+func spdxDigest(digest string) []spdxChecksum {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return nil
+	}
+	return []spdxChecksum{{"SHA256", strings.TrimPrefix(digest, "sha256:")}}
+}
+
+// CycloneDX 1.5 JSON document, see https://cyclonedx.org/docs/1.5/json/
+type cycloneDXDocument struct {
+	BOMFormat    string               `json:"bomFormat"`
+	SpecVersion  string               `json:"specVersion"`
+	SerialNumber string               `json:"serialNumber"`
+	Version      int                  `json:"version"`
+	Metadata     cycloneDXMetadata    `json:"metadata"`
+	Components   []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Tools     []cycloneDXTool    `json:"tools"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXTool struct {
+	Vendor  string `json:"vendor"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type cycloneDXComponent struct {
+	BOMRef      string          `json:"bom-ref,omitempty"`
+	Type        string          `json:"type"`
+	Name        string          `json:"name"`
+	Version     string          `json:"version,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Publisher   string          `json:"publisher,omitempty"`
+	PURL        string          `json:"purl,omitempty"`
+	Hashes      []cycloneDXHash `json:"hashes,omitempty"`
+}
+
+type cycloneDXHash struct {
+	Algorithm string `json:"alg"`
+	Content   string `json:"content"`
+}
+
+// newCycloneDXDocument describes the image as the metadata component,
+// with the base image, RPM packages, addons, and Docker context files as its components
+func newCycloneDXDocument(contents sbomContents) (cycloneDXDocument, error) {
+	uuid, err := newUUID()
+	if err != nil {
+		return cycloneDXDocument{}, err
+	}
+	document := cycloneDXDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + uuid,
+		Version:      1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: contents.Created.Format(time.RFC3339),
+			Tools:     []cycloneDXTool{{"SAS Institute Inc.", "sas-container-recipes", RecipeVersion}},
+			Component: cycloneDXComponent{
+				BOMRef:  contents.ImageName,
+				Type:    "container",
+				Name:    contents.ImageName,
+				Version: contents.ImageTag,
+				Hashes:  cycloneDXDigest(contents.ImageID),
+			},
+		},
+	}
+
+	document.Components = append(document.Components, cycloneDXComponent{
+		BOMRef: "base-image:" + contents.BaseImage,
+		Type:   "container",
+		Name:   contents.BaseImage,
+		Hashes: cycloneDXDigest(contents.BaseImageDigest),
+	})
+
+	for _, pkg := range contents.Packages {
+		purl := pkg.purl(contents.Platform)
+		publisher := ""
+		if pkg.Vendor != "(none)" {
+			publisher = pkg.Vendor
+		}
+		document.Components = append(document.Components, cycloneDXComponent{
+			BOMRef:    purl,
+			Type:      "library",
+			Name:      pkg.Name,
+			Version:   pkg.Version,
+			Publisher: publisher,
+			PURL:      purl,
+		})
+	}
+
+	for _, addon := range contents.Addons {
+		document.Components = append(document.Components, cycloneDXComponent{
+			BOMRef:      "addon:" + addon.Name,
+			Type:        "application",
+			Name:        addon.Name,
+			Description: addon.Description,
+		})
+	}
+
+	for _, name := range contents.Files {
+		document.Components = append(document.Components, cycloneDXComponent{
+			BOMRef: "file:" + name,
+			Type:   "file",
+			Name:   name,
+			Hashes: []cycloneDXHash{{"SHA-256", contents.FileDigests[name]}},
+		})
+	}
+	return document, nil
+}
+
+// cycloneDXDigest converts a "sha256:<hex>" image digest into a CycloneDX hash
+func cycloneDXDigest(digest string) []cycloneDXHash {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return nil
+	}
+	return []cycloneDXHash{{"SHA-256", strings.TrimPrefix(digest, "sha256:")}}
+}
@@ -0,0 +1,193 @@
+// scan.go
+// Scans each built image for vulnerabilities before it is pushed. An image
+// with findings at or above the --scan-severity level is not pushed.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// ImageScanner scans a built image for vulnerabilities
+type ImageScanner interface {
+	Scan(container *Container) (ScanResult, error)
+}
+
+// ScanSeverities from the least to the most severe. The --scan-severity argument is one of these.
+var ScanSeverities = []string{"UNKNOWN", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+// severityRank gets the position of the severity in ScanSeverities, or -1 if it is not known
+func severityRank(severity string) int {
+	for index, name := range ScanSeverities {
+		if strings.EqualFold(name, severity) {
+			return index
+		}
+	}
+	return -1
+}
+
+// ScanFinding is a single vulnerability in an image
+type ScanFinding struct {
+	ID               string
+	Package          string
+	InstalledVersion string
+	FixedVersion     string
+	Severity         string
+	Title            string
+}
+
+// ScanResult holds the findings of a scan and the number of findings of each severity
+type ScanResult struct {
+	Findings []ScanFinding
+	Counts   map[string]int
+}
+
+// Blocking gets the findings at or above the severity, sorted from the most to the least severe
+func (result ScanResult) Blocking(severity string) []ScanFinding {
+	threshold := severityRank(severity)
+	blocking := []ScanFinding{}
+	for _, finding := range result.Findings {
+		if severityRank(finding.Severity) >= threshold {
+			blocking = append(blocking, finding)
+		}
+	}
+	sort.SliceStable(blocking, func(i, j int) bool {
+		return severityRank(blocking[i].Severity) > severityRank(blocking[j].Severity)
+	})
+	return blocking
+}
+
+// passesScan checks the counts of a previous scan against the severity. Counts that are
+// missing, such as for an image that was built without a scan, do not pass.
+func passesScan(counts map[string]int, severity string) bool {
+	if len(counts) == 0 {
+		return false
+	}
+	threshold := severityRank(severity)
+	for name, count := range counts {
+		if count > 0 && severityRank(name) >= threshold {
+			return false
+		}
+	}
+	return true
+}
+
+// TrivyScanner runs a Trivy compatible command and reads its JSON report
+type TrivyScanner struct {
+	Command  string // Path to the scanner
+	CacheDir string // Optional: use the vulnerability database in this directory instead of downloading it
+}
+
+// trivyReport is the part of Trivy's JSON report that is read
+type trivyReport struct {
+	Results []struct {
+		Target          string `json:"Target"`
+		Vulnerabilities []struct {
+			VulnerabilityID  string `json:"VulnerabilityID"`
+			PkgName          string `json:"PkgName"`
+			InstalledVersion string `json:"InstalledVersion"`
+			FixedVersion     string `json:"FixedVersion"`
+			Severity         string `json:"Severity"`
+			Title            string `json:"Title"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+// Scan runs the scanner against the image in the local Docker daemon
+func (scanner *TrivyScanner) Scan(container *Container) (ScanResult, error) {
+	result := ScanResult{Counts: make(map[string]int)}
+	arguments := []string{"image", "--format", "json", "--quiet", "--exit-code", "0"}
+	if len(scanner.CacheDir) > 0 {
+		arguments = append(arguments, "--cache-dir", scanner.CacheDir, "--skip-db-update")
+	}
+	arguments = append(arguments, container.GetWholeImageName())
+	container.WriteLog(scanner.Command + " " + strings.Join(arguments, " "))
+
+	command := exec.CommandContext(container.SoftwareOrder.BuildContext, scanner.Command, arguments...)
+	stderr := new(bytes.Buffer)
+	command.Stderr = stderr
+	output, err := command.Output()
+	if err != nil {
+		return result, fmt.Errorf("%s failed, %s %s", scanner.Command, err.Error(), strings.TrimSpace(stderr.String()))
+	}
+
+	report := trivyReport{}
+	err = json.Unmarshal(output, &report)
+	if err != nil {
+		return result, fmt.Errorf("unable to read the JSON report of %s, %s", scanner.Command, err.Error())
+	}
+	for _, target := range report.Results {
+		for _, vulnerability := range target.Vulnerabilities {
+			severity := strings.ToUpper(vulnerability.Severity)
+			if severityRank(severity) < 0 {
+				severity = "UNKNOWN"
+			}
+			result.Findings = append(result.Findings, ScanFinding{
+				ID:               vulnerability.VulnerabilityID,
+				Package:          vulnerability.PkgName,
+				InstalledVersion: vulnerability.InstalledVersion,
+				FixedVersion:     vulnerability.FixedVersion,
+				Severity:         severity,
+				Title:            vulnerability.Title,
+			})
+			result.Counts[severity]++
+		}
+	}
+	return result, nil
+}
+
+// ScanImage scans the built image, writes the findings to the container's log,
+// and returns an error if any finding is at or above the --scan-severity level
+func (container *Container) ScanImage() error {
+	result, err := container.SoftwareOrder.Scanner.Scan(container)
+	if err != nil {
+		return err
+	}
+	// Every severity is counted, even with no findings, so the build report shows that the image was scanned
+	container.ScanCounts = make(map[string]int)
+	for _, severity := range ScanSeverities {
+		container.ScanCounts[severity] = result.Counts[severity]
+	}
+
+	counts := []string{}
+	for index := len(ScanSeverities) - 1; index >= 0; index-- {
+		counts = append(counts, fmt.Sprintf("%s: %d", ScanSeverities[index], result.Counts[ScanSeverities[index]]))
+	}
+	container.WriteLog("----- Vulnerability Scan -----")
+	container.WriteLog(fmt.Sprintf("%d findings (%s)", len(result.Findings), strings.Join(counts, ", ")))
+
+	blocking := result.Blocking(container.SoftwareOrder.ScanSeverity)
+	for _, finding := range blocking {
+		fixed := "no fix"
+		if len(finding.FixedVersion) > 0 {
+			fixed = "fixed in " + finding.FixedVersion
+		}
+		container.WriteLog(fmt.Sprintf("%s %s %s %s (%s) %s",
+			finding.Severity, finding.ID, finding.Package, finding.InstalledVersion, fixed, finding.Title))
+	}
+	if len(blocking) > 0 {
+		return fmt.Errorf("%d vulnerabilities at or above %s severity were found. See %s",
+			len(blocking), container.SoftwareOrder.ScanSeverity, container.LogPath)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+// selection.go
+// Chooses the containers to build from the '--build-only' argument, which
+// accepts container names, glob patterns, and @group names.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// BuildGroups can be used in the '--build-only' argument as @<group name>.
+// The host groups in the playbook's inventory can also be used as @<group name>.
+var BuildGroups = map[string][]string{
+	"core-services": {"consul", "httpproxy", "pgpoolc", "rabbitmq", "sasdatasvrc"},
+}
+
+// ServiceDependencies are the containers that a container needs at runtime.
+// The "*" entry applies to every container that does not have its own entry.
+var ServiceDependencies = map[string][]string{
+	"*":           {"consul", "rabbitmq", "sasdatasvrc", "httpproxy"},
+	"consul":      {},
+	"httpproxy":   {"consul"},
+	"pgpoolc":     {"consul", "sasdatasvrc"},
+	"rabbitmq":    {"consul"},
+	"sasdatasvrc": {"consul", "pgpoolc"},
+}
+
+// SelectContainers gets the names of the containers in the order that match the '--build-only' list,
+// along with their runtime dependencies if '--with-dependencies' is used. Every entry in the list must
+// match at least one container.
+func (order *SoftwareOrder) SelectContainers() ([]string, error) {
+	available := []string{}
+	for name := range order.Containers {
+		available = append(available, name)
+	}
+	sort.Strings(available)
+
+	selected := make(map[string]bool)
+	problems := []string{}
+	for _, entry := range order.BuildOnly {
+		matches, err := order.matchBuildOnly(entry, available)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if len(matches) == 0 {
+			problem := fmt.Sprintf("'%s' does not match any container in the order", entry)
+			if suggestions := suggestNames(strings.TrimPrefix(entry, "@"), available); len(suggestions) > 0 {
+				problem += ". Did you mean " + strings.Join(suggestions, ", ") + "?"
+			}
+			problems = append(problems, problem)
+			continue
+		}
+		for _, name := range matches {
+			selected[name] = true
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("One or more of the chosen --build-only containers do not exist:\n  %s\nAvailable Image Builds: %s",
+			strings.Join(problems, "\n  "), strings.Join(available, ", "))
+	}
+
+	// Add the dependencies of the selected containers, and then their dependencies
+	if order.WithDependencies {
+		queue := []string{}
+		for name := range selected {
+			queue = append(queue, name)
+		}
+		for len(queue) > 0 {
+			name := queue[0]
+			queue = queue[1:]
+			dependencies, found := ServiceDependencies[name]
+			if !found {
+				dependencies = ServiceDependencies["*"]
+			}
+			for _, dependency := range dependencies {
+				if _, inOrder := order.Containers[dependency]; inOrder && !selected[dependency] {
+					selected[dependency] = true
+					queue = append(queue, dependency)
+				}
+			}
+		}
+	}
+
+	names := []string{}
+	for name := range selected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// matchBuildOnly gets the available containers that match a single '--build-only' entry
+func (order *SoftwareOrder) matchBuildOnly(entry string, available []string) ([]string, error) {
+	patterns := []string{entry}
+	if strings.HasPrefix(entry, "@") {
+		groupName := strings.TrimPrefix(entry, "@")
+		members, err := order.buildGroupMembers(groupName)
+		if err != nil {
+			return nil, err
+		}
+		patterns = members
+	}
+
+	matches := []string{}
+	for _, pattern := range patterns {
+		for _, name := range available {
+			matched, err := path.Match(strings.ToLower(pattern), name)
+			if err != nil {
+				return nil, fmt.Errorf("'%s' is not a valid pattern, %s", entry, err.Error())
+			}
+			if matched {
+				matches = appendUnique(matches, name)
+			}
+		}
+	}
+	return matches, nil
+}
+
+// buildGroupMembers gets the containers of a BuildGroups entry or of a host group in the playbook's inventory
+func (order *SoftwareOrder) buildGroupMembers(groupName string) ([]string, error) {
+	if members, found := BuildGroups[groupName]; found {
+		return members, nil
+	}
+	groupNames := []string{}
+	for name := range BuildGroups {
+		groupNames = append(groupNames, "@"+name)
+	}
+
+	inventory, err := LoadInventory(order.BuildPath + "sas_viya_playbook/inventory.ini")
+	if err == nil {
+		if group, found := inventory.Groups[groupName]; found && len(group.Children) > 0 {
+			return inventory.MemberGroups(groupName)
+		}
+		for name, group := range inventory.Groups {
+			if len(group.Children) > 0 && name != "all" {
+				groupNames = append(groupNames, "@"+name)
+			}
+		}
+	}
+
+	sort.Strings(groupNames)
+	problem := fmt.Sprintf("'@%s' is not a group", groupName)
+	if suggestions := suggestNames("@"+groupName, groupNames); len(suggestions) > 0 {
+		problem += ". Did you mean " + strings.Join(suggestions, ", ") + "?"
+	}
+	return nil, fmt.Errorf("%s Groups: %s", problem, strings.Join(groupNames, ", "))
+}
+
+// suggestNames gets the options that are close to the name: options that contain
+// the name, or that are only a few edits away from it. The closest are first.
+func suggestNames(name string, options []string) []string {
+	name = strings.ToLower(name)
+	if len(name) == 0 {
+		return nil
+	}
+	maxDistance := len(name)/3 + 1
+	type suggestion struct {
+		name     string
+		distance int
+	}
+	suggestions := []suggestion{}
+	for _, option := range options {
+		distance := editDistance(name, strings.ToLower(option))
+		if strings.Contains(strings.ToLower(option), name) {
+			distance = 0
+		}
+		if distance <= maxDistance {
+			suggestions = append(suggestions, suggestion{option, distance})
+		}
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].distance < suggestions[j].distance
+	})
+
+	names := []string{}
+	for index, item := range suggestions {
+		if index == 3 {
+			break
+		}
+		names = append(names, item.name)
+	}
+	return names
+}
+
+// editDistance gets the Levenshtein distance between two strings
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// minInt gets the smaller of two integers
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,183 @@
+// signer.go
+// Signs each image after it is pushed. The built-in signer uses a local
+// private key and stores the signature in the registry in the same format as
+// cosign, so the images can be checked with `cosign verify --key <public key>`.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ImageSigner signs an image once it has been pushed to the registry
+type ImageSigner interface {
+	// Sign signs the image's manifest digest and returns the digest of the stored signature
+	Sign(container *Container, digest string) (string, error)
+}
+
+// Media types of a cosign signature
+const (
+	cosignSignatureMediaType  = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	ociManifestMediaType      = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType        = "application/vnd.oci.image.config.v1+json"
+)
+
+// KeySigner signs images with a private key from a PEM file
+type KeySigner struct {
+	KeyPath string
+	key     crypto.Signer
+}
+
+// NewKeySigner reads an unencrypted ECDSA or RSA private key from a PEM file,
+// such as one created by `openssl ecparam -genkey -name prime256v1 -noout`
+func NewKeySigner(keyPath string) (*KeySigner, error) {
+	content, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("the --sign-key file %s is not a PEM file", keyPath)
+	}
+	if strings.Contains(block.Type, "ENCRYPTED") {
+		return nil, fmt.Errorf("the --sign-key file %s is encrypted. Provide an unencrypted ECDSA or RSA private key", keyPath)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the --sign-key file %s, %s", keyPath, err.Error())
+	}
+
+	switch key.(type) {
+	case *ecdsa.PrivateKey, *rsa.PrivateKey:
+		return &KeySigner{KeyPath: keyPath, key: key.(crypto.Signer)}, nil
+	}
+	return nil, fmt.Errorf("the --sign-key file %s must have an ECDSA or RSA private key", keyPath)
+}
+
+// cosignPayload is the "simple signing" document that is signed for an image
+type cosignPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]string `json:"optional"`
+}
+
+// ociDescriptor points to a blob in an OCI manifest
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Size        int               `json:"size"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest is an OCI image manifest, which holds the signature in its only layer
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// Sign signs the digest and pushes the signature to the image's repository
+// with the tag sha256-<digest>.sig, which is where cosign looks for it
+func (signer *KeySigner) Sign(container *Container, digest string) (string, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", fmt.Errorf("unable to sign %s, the registry did not return the digest of the pushed image", container.GetWholeImageName())
+	}
+
+	payload := cosignPayload{Optional: map[string]string{"sas.recipe.version": RecipeVersion}}
+	payload.Critical.Identity.DockerReference = container.SoftwareOrder.DockerRegistry + "/" + container.getRepository()
+	payload.Critical.Image.DockerManifestDigest = digest
+	payload.Critical.Type = "cosign container image signature"
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(payloadBytes)
+	signature, err := signer.key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+
+	registry, err := newRegistryClient(container.SoftwareOrder.DockerRegistry, container.SoftwareOrder.RegistryAuth)
+	if err != nil {
+		return "", err
+	}
+	repository := container.getRepository()
+	payloadDigest, err := registry.PushBlob(repository, payloadBytes)
+	if err != nil {
+		return "", err
+	}
+
+	// The config is the same as the one cosign writes, with the payload as the only layer
+	config := fmt.Sprintf(`{"architecture":"","config":{},"created":"0001-01-01T00:00:00Z","history":[{"created":"0001-01-01T00:00:00Z"}],"os":"","rootfs":{"type":"layers","diff_ids":["%s"]}}`, payloadDigest)
+	configDigest, err := registry.PushBlob(repository, []byte(config))
+	if err != nil {
+		return "", err
+	}
+
+	manifest, err := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        ociDescriptor{MediaType: ociConfigMediaType, Size: len(config), Digest: configDigest},
+		Layers: []ociDescriptor{{
+			MediaType:   cosignSignatureMediaType,
+			Size:        len(payloadBytes),
+			Digest:      payloadDigest,
+			Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)},
+		}},
+	})
+	if err != nil {
+		return "", err
+	}
+	signatureTag := strings.Replace(digest, ":", "-", 1) + ".sig"
+	signatureDigest, err := registry.PushManifest(repository, signatureTag, ociManifestMediaType, manifest)
+	if err != nil {
+		return "", err
+	}
+	container.WriteLog(fmt.Sprintf("Signed %s@%s with %s, signature %s:%s@%s",
+		container.GetWholeImageName(), digest, signer.KeyPath, repository, signatureTag, signatureDigest))
+	return signatureDigest, nil
+}
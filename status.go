@@ -0,0 +1,229 @@
+// status.go
+// Serves the state of the build on the '--status-addr' so that monitoring can
+// follow the container builds and alert on a build that is stuck.
+//
+// Copyright 2018 SAS Institute Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Phases of the build that are shown by the status server
+const (
+	PhasePreparing = "preparing" // The order is loaded and the Docker contexts are created
+	PhaseBuilding  = "building"  // The images are built and pushed
+	PhaseFinished  = "finished"
+	PhaseFailed    = "failed"
+)
+
+// statusStates are the container states that are counted in the metrics. DoNotBuild containers are left out.
+var statusStates = []State{Loaded, Building, Built, Pushing, Pushed, Retagged, Failed}
+
+// StatusServer serves the '/status' and '/metrics' endpoints. It has its own
+// handlers, so the entitlement and CA that Serve hands out are not on its address.
+type StatusServer struct {
+	Address string
+
+	lock     sync.Mutex
+	listener net.Listener
+	order    *SoftwareOrder
+	view     *ProgressView // The state of each container. Set when the builds start
+	phase    string
+}
+
+// BuildStatus is the document of the '/status' endpoint
+type BuildStatus struct {
+	DeploymentType string            `json:"deployment_type"`
+	Tag            string            `json:"tag"`
+	Phase          string            `json:"phase"`
+	StartTime      time.Time         `json:"start_time"`
+	ElapsedSeconds float64           `json:"elapsed_seconds"`
+	QueueDepth     int               `json:"queue_depth"` // Containers that are waiting for a build worker
+	Containers     []ContainerStatus `json:"containers"`
+}
+
+// StartStatusServer listens on the address and serves the status of the order in the background.
+// The address is listened on before it returns, so an address that is in use fails the build right away.
+func StartStatusServer(address string, order *SoftwareOrder) (*StatusServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on the '--status-addr' %s. %s", address, err.Error())
+	}
+	server := &StatusServer{Address: listener.Addr().String(), listener: listener, order: order, phase: PhasePreparing}
+
+	handlers := http.NewServeMux()
+	handlers.HandleFunc("/status", server.serveStatus)
+	handlers.HandleFunc("/metrics", server.serveMetrics)
+	go http.Serve(listener, handlers)
+
+	order.WriteLog(true, "Serving the build status on http://"+server.Address+"/status and http://"+server.Address+"/metrics")
+	return server, nil
+}
+
+// statusGracePeriod is how long the status is still served after the build ends,
+// so that a scraper sees the finished or failed phase
+const statusGracePeriod = 15 * time.Second
+
+// Close stops listening on the address after the statusGracePeriod
+func (server *StatusServer) Close() error {
+	if server == nil {
+		return nil
+	}
+	server.lock.Lock()
+	phase := server.phase
+	server.lock.Unlock()
+	server.order.WriteLog(true, fmt.Sprintf("Serving the %s build status for %s before exiting", phase, statusGracePeriod))
+	time.Sleep(statusGracePeriod)
+	return server.listener.Close()
+}
+
+// Watch serves the state of the containers in the view, which is kept up to date by the build workers
+func (server *StatusServer) Watch(view *ProgressView) {
+	if server == nil {
+		return
+	}
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.view = view
+	server.phase = PhaseBuilding
+}
+
+// SetPhase sets the phase of the build that is served
+func (server *StatusServer) SetPhase(phase string) {
+	if server == nil {
+		return
+	}
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.phase = phase
+}
+
+// Status gets the current state of the build and each of its containers
+func (server *StatusServer) Status() BuildStatus {
+	server.lock.Lock()
+	view := server.view
+	phase := server.phase
+	server.lock.Unlock()
+
+	status := BuildStatus{
+		DeploymentType: server.order.DeploymentType,
+		Tag:            server.order.GetTag(),
+		Phase:          phase,
+		StartTime:      server.order.StartTime,
+		ElapsedSeconds: time.Since(server.order.StartTime).Seconds(),
+		Containers:     view.Snapshot(),
+	}
+	for _, container := range status.Containers {
+		if container.State == Loaded.String() {
+			status.QueueDepth++
+		}
+	}
+	return status
+}
+
+// serveStatus writes the status as JSON
+func (server *StatusServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	content, err := json.MarshalIndent(server.Status(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
+
+// serveMetrics writes the status in the Prometheus text format.
+// A stuck build can be found by comparing sas_recipe_container_last_update_timestamp_seconds with time().
+func (server *StatusServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	status := server.Status()
+	metrics := &bytes.Buffer{}
+
+	writeMetricHeader(metrics, "sas_recipe_build_info", "gauge", "The build's deployment type, recipe version, tag, and phase")
+	fmt.Fprintf(metrics, "sas_recipe_build_info{deployment_type=\"%s\",recipe_version=\"%s\",tag=\"%s\",phase=\"%s\"} 1\n",
+		escapeLabel(status.DeploymentType), escapeLabel(RecipeVersion), escapeLabel(status.Tag), escapeLabel(status.Phase))
+	writeMetricHeader(metrics, "sas_recipe_build_start_timestamp_seconds", "gauge", "When the build started")
+	fmt.Fprintf(metrics, "sas_recipe_build_start_timestamp_seconds %d\n", status.StartTime.Unix())
+
+	counts := make(map[string]int)
+	for _, container := range status.Containers {
+		counts[container.State]++
+	}
+	writeMetricHeader(metrics, "sas_recipe_build_containers", "gauge", "Number of containers in each state")
+	for _, state := range statusStates {
+		fmt.Fprintf(metrics, "sas_recipe_build_containers{state=\"%s\"} %d\n", state, counts[state.String()])
+	}
+	writeMetricHeader(metrics, "sas_recipe_build_queue_depth", "gauge", "Number of containers that are waiting for a build worker")
+	fmt.Fprintf(metrics, "sas_recipe_build_queue_depth %d\n", status.QueueDepth)
+	writeMetricHeader(metrics, "sas_recipe_build_failed_containers", "gauge", "Number of containers that failed to build or push")
+	fmt.Fprintf(metrics, "sas_recipe_build_failed_containers %d\n", counts[Failed.String()])
+
+	writeContainerMetric(metrics, status.Containers, "sas_recipe_container_build_seconds",
+		"Time the image has been building, or took to build", func(container ContainerStatus) (float64, bool) {
+			return container.BuildSeconds, container.BuildStart != nil
+		})
+	writeContainerMetric(metrics, status.Containers, "sas_recipe_container_push_seconds",
+		"Time the image has been pushing, or took to push", func(container ContainerStatus) (float64, bool) {
+			return container.PushSeconds, container.PushSeconds > 0
+		})
+	writeContainerMetric(metrics, status.Containers, "sas_recipe_container_image_size_bytes",
+		"Size of the built image", func(container ContainerStatus) (float64, bool) {
+			return float64(container.ImageSize), container.ImageSize > 0
+		})
+	writeContainerMetric(metrics, status.Containers, "sas_recipe_container_last_update_timestamp_seconds",
+		"When the container's state or Dockerfile step last changed", func(container ContainerStatus) (float64, bool) {
+			if container.Updated == nil {
+				return 0, false
+			}
+			return float64(container.Updated.Unix()), true
+		})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(metrics.Bytes())
+}
+
+// writeMetricHeader writes the HELP and TYPE lines of a metric
+func writeMetricHeader(metrics *bytes.Buffer, name string, metricType string, help string) {
+	fmt.Fprintf(metrics, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// writeContainerMetric writes a gauge with a sample for each container that has a value
+func writeContainerMetric(metrics *bytes.Buffer, containers []ContainerStatus, name string, help string,
+	value func(ContainerStatus) (float64, bool)) {
+	writeMetricHeader(metrics, name, "gauge", help)
+	for _, container := range containers {
+		if sample, found := value(container); found {
+			fmt.Fprintf(metrics, "%s{container=\"%s\"} %s\n", name, escapeLabel(container.Name), strconv.FormatFloat(sample, 'f', -1, 64))
+		}
+	}
+}
+
+// labelEscaper escapes the characters that cannot be in a Prometheus label value
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a Prometheus label value
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}